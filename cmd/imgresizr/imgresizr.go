@@ -10,6 +10,7 @@ import (
 	"runtime"
 	rd "runtime/debug"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,7 +19,6 @@ import (
 	"github.com/Dmit1812/imgresizr/internal/lrufilecache"
 	internalhttp "github.com/Dmit1812/imgresizr/internal/server"
 	"github.com/Dmit1812/imgresizr/internal/utilities"
-	"github.com/h2non/bimg"
 )
 
 func main() {
@@ -26,7 +26,8 @@ func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, c.Usage, utilities.Version(),
-			runtime.NumCPU(), c.EnvAddr, c.EnvPort, c.EnvFCacheSize, c.EnvMCacheSize, c.EnvLogLevel)
+			runtime.NumCPU(), c.EnvAddr, c.EnvPort, c.EnvFCacheSize, c.EnvMCacheSize, c.EnvTCacheSize, c.EnvLogLevel,
+			c.EnvThumborKey)
 	}
 
 	c.InitParams()
@@ -42,8 +43,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(*c.PEngine) > 0 {
+		if err := internalhttp.SetEngine(*c.PEngine); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
 	if *c.PVersion || *c.PVersionLong {
-		fmt.Printf("imgresizr. bimg version: %s, vips version: %s\n", bimg.Version, bimg.VipsVersion)
+		fmt.Printf("imgresizr. %s\n", internalhttp.EngineVersion())
 		os.Exit(1)
 	}
 
@@ -77,6 +86,7 @@ func main() {
 	port := getEnvInt(c.EnvPort, *c.PPort)
 	fcachesize := getEnvInt(c.EnvFCacheSize, *c.PFCacheSize)
 	mcachesize := getEnvInt(c.EnvMCacheSize, *c.PMCacheSize)
+	tcachesize := getEnvInt(c.EnvTCacheSize, *c.PTCacheSize)
 
 	opts := &internalhttp.Server{
 		Address:          addr,
@@ -88,20 +98,94 @@ func main() {
 		HTTPReadTimeout:  c.OReadTimeout,
 		HTTPWriteTimeout: c.OWriteTimeout,
 		ShutdownTimeout:  c.OShutdownTimeout,
+		FetchTimeout:     c.OFetchTimeout,
+		ProcessTimeout:   c.OProcessTimeout,
+		SendTimeout:      c.OSendTimeout,
 		CurrentVersions:  utilities.Version(),
 		Log:              log,
 		BaseImageCache: lrufilecache.NewLRUFileCache(fcachesize, mcachesize,
 			*c.PCachePath, log),
 		ConvertedImageCache: lrufilecache.NewLRUFileCache(fcachesize, mcachesize,
 			path.Join(*c.PCachePath, c.OCacheConvertedDir), log),
+		TileCache: lrufilecache.NewLRUFileCache(tcachesize, mcachesize,
+			path.Join(*c.PCachePath, c.OCacheTilesDir), log),
+		AllowSVG:        *c.PAllowSVG,
+		AllowPDF:        *c.PAllowPDF,
+		ClientHints:     *c.PClientHints,
+		MaxDPR:          *c.PMaxDPR,
+		SaveDataQuality: c.OSaveDataQuality,
+		FontPath:        *c.PFontPath,
+		Thumbor:         *c.PThumbor,
+		ThumborKey:      getEnvStr(c.EnvThumborKey, *c.PThumborKey),
+		CarveMaxPixels:  *c.PCarvePixels,
+		MaxSourceBytes:  *c.PMaxBytes,
+		MaxSourcePixels: *c.PMaxPixels,
+		MaxWidth:        *c.PMaxWidth,
+		MaxHeight:       *c.PMaxHeight,
+		MaxArea:         *c.PMaxArea,
+		Workers:         *c.PWorkers,
+		QueueSize:       *c.PQueueSize,
+		QueueTimeout:    *c.PQueueWait,
+		PrioritizeSmall: *c.PPrioritize,
+		RetryAfter:      c.ORetryAfter,
+		UserAgent:       *c.PUserAgent,
+		Retries:         *c.PRetries,
+		RetryBackoff:    *c.PBackoff,
+		BreakerFailures: *c.PBreakerFail,
+		BreakerCooldown: *c.PBreakerWait,
+		MinCacheTTL:     *c.PMinCacheTTL,
+		MaxCacheTTL:     *c.PMaxCacheTTL,
+		StalePolicy:     internalhttp.StalePolicy{WhileRevalidate: *c.PStaleReval, IfError: *c.PStaleError},
 	}
 
-	opts.ErrorImage, _, err = utilities.LoadImage(*c.PErrorImage, c.OErrorImage, c.OPaths)
+	opts.OriginStalePolicies, err = internalhttp.ParseStalePolicies(*c.POriginStale)
 	if err != nil {
 		log.Error(err.Error())
 		os.Exit(1)
 	}
 
+	opts.Client, err = internalhttp.NewHTTPClient(internalhttp.ClientConfig{
+		MaxIdleConns:        *c.PIdleConns,
+		MaxIdleConnsPerHost: *c.PHostConns,
+		MaxConnsPerHost:     *c.PMaxConns,
+		IdleConnTimeout:     time.Duration(*c.PIdleTimeout) * time.Second,
+		DialTimeout:         time.Duration(*c.PDialTimeout) * time.Second,
+		TLSHandshakeTimeout: time.Duration(*c.PTLSTimeout) * time.Second,
+		CAFile:              *c.PCAFile,
+		InsecureHosts:       splitList(*c.PInsecure),
+		DisableHTTP2:        *c.PNoHTTP2,
+		Proxy:               *c.PProxy,
+	})
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	opts.NoErrorImage = *c.PNoErrorImg
+	if !opts.NoErrorImage {
+		opts.ErrorImage, _, err = utilities.LoadImage(*c.PErrorImage, c.OErrorImage, c.OPaths)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		opts.ErrorImages = map[string][]byte{}
+		for class, path := range map[string]string{
+			internalhttp.ErrorClassNotFound: *c.PNotFoundImg,
+			internalhttp.ErrorClassBadImage: *c.PBadImageImg,
+			internalhttp.ErrorClassTimeout:  *c.PTimeoutImg,
+		} {
+			if path == "" {
+				continue
+			}
+			opts.ErrorImages[class], _, err = utilities.LoadImage(path, "", nil)
+			if err != nil {
+				log.Error(err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -145,6 +229,17 @@ func getEnvStr(envKey string, val string) string {
 	return val
 }
 
+// splitList splits a comma separated list dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func runGCToReleaseMemoryContinuously(interval int, log *logger.Logger) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 
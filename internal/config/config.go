@@ -1,19 +1,67 @@
 package config
 
-import "flag"
+import (
+	"flag"
+	"runtime"
+
+	"github.com/Dmit1812/imgresizr/internal/utilities"
+)
 
 var (
 	PAddr        = flag.String("a", "", "bind address")
 	PPort        = flag.Int("p", 9000, "port to listen")
 	PFCacheSize  = flag.Int("cf", 2, "how many images to keep in filesystem as a cache")
 	PMCacheSize  = flag.Int("cm", 1, "how many images to keep in memory as a cache")
+	PTCacheSize  = flag.Int("ct", 100, "how many deep zoom tiles to keep in filesystem as a cache")
 	PCachePath   = flag.String("cp", "./cache", "where would the cache for images be located")
 	PVersion     = flag.Bool("v", false, "Show version")
 	PVersionLong = flag.Bool("version", false, "Show version")
 	PHelp        = flag.Bool("h", false, "Show help")
 	PHelpLong    = flag.Bool("help", false, "Show help")
 	PErrorImage  = flag.String("errorimage", "", "Path to image to return as Error")
+	PNotFoundImg = flag.String("notfoundimage", "", "Path to image to return when the source is not found")
+	PBadImageImg = flag.String("badimageimage", "", "Path to image to return when the source is not a valid image")
+	PTimeoutImg  = flag.String("timeoutimage", "", "Path to image to return when the source download timed out")
+	PNoErrorImg  = flag.Bool("noerrorimage", false, "Answer errors with the message as text instead of an image")
 	PLogLevel    = flag.Int("loglevel", 1, "Set log level (1 - debug, 2 - info, 3 - warn, 4 - error)")
+	PAllowSVG    = flag.Bool("svg", false, "Allow SVG source images")
+	PAllowPDF    = flag.Bool("pdf", false, "Allow PDF source documents")
+	PMaxDPR      = flag.Float64("maxdpr", 3, "Maximum device pixel ratio the dimensions can be multiplied by")
+	PClientHints = flag.Bool("clienthints", false, "Use Client Hints request headers for sizing and quality")
+	PFontPath    = flag.String("fontpath", "", "Directory with the fonts for text overlays, built in font if empty")
+	PThumbor     = flag.Bool("thumbor", false, "Accept URLs in the thumbor dialect")
+	PThumborKey  = flag.String("thumborkey", "", "Key thumbor URLs are signed with")
+	PCarvePixels = flag.Int("carvemaxpixels", 250000, "Maximum pixels the carve operation works on")
+	PEngine      = flag.String("engine", "", "Image processing engine: bimg or go")
+	PMaxBytes    = flag.Int64("maxsourcebytes", 50<<20, "Maximum size of a downloaded source image in bytes")
+	PMaxPixels   = flag.Int64("maxsourcepixels", 100000000, "Maximum pixels of a source image")
+	PMaxWidth    = flag.Int("maxwidth", 10000, "Maximum width of a resized image")
+	PMaxHeight   = flag.Int("maxheight", 10000, "Maximum height of a resized image")
+	PMaxArea     = flag.Int64("maxarea", 50000000, "Maximum width times height of a resized image")
+	PWorkers     = flag.Int("workers", runtime.NumCPU(), "Maximum conversions running at once")
+	PQueueSize   = flag.Int("queue", 100, "Maximum conversions waiting for a worker")
+	PQueueWait   = flag.Int("queuetimeout", 10, "Seconds a conversion may wait for a worker")
+	PPrioritize  = flag.Bool("prioritize", false, "Let conversions producing fewer pixels skip ahead in the queue")
+	PIdleConns   = flag.Int("idleconns", 100, "Maximum idle connections to source servers")
+	PHostConns   = flag.Int("idleconnsperhost", 10, "Maximum idle connections per source server")
+	PMaxConns    = flag.Int("connsperhost", 0, "Maximum connections per source server, 0 for no limit")
+	PIdleTimeout = flag.Int("idletimeout", 90, "Seconds an idle connection to a source server is kept")
+	PDialTimeout = flag.Int("dialtimeout", 10, "Seconds connecting to a source server may take")
+	PTLSTimeout  = flag.Int("tlstimeout", 10, "Seconds the TLS handshake with a source server may take")
+	PCAFile      = flag.String("cafile", "", "PEM bundle of CA certificates trusted for source servers")
+	PInsecure    = flag.String("insecurehosts", "", "Comma separated hosts whose certificates are not verified")
+	PNoHTTP2     = flag.Bool("nohttp2", false, "Do not use HTTP/2 for source downloads")
+	PProxy       = flag.String("proxy", "", "HTTP or SOCKS5 proxy URL for source downloads")
+	PUserAgent   = flag.String("useragent", "imgresizr/"+utilities.Version(), "User-Agent of source downloads")
+	PRetries     = flag.Int("retries", 2, "Retries of source downloads failing to connect or with 502/503/504")
+	PBackoff     = flag.Int("retrybackoff", 100, "Milliseconds before the first retry, doubled for every next one")
+	PBreakerFail = flag.Int("breakerfailures", 5, "Consecutive failures opening the circuit breaker of a host")
+	PBreakerWait = flag.Int("breakercooldown", 30, "Seconds requests to a host fail fast once its breaker opened")
+	PMinCacheTTL = flag.Int("mincachettl", 60, "Minimum seconds a cached source image is used before revalidation")
+	PMaxCacheTTL = flag.Int("maxcachettl", 0, "Maximum seconds a cached source image is used before revalidation")
+	PStaleReval  = flag.Int("stalewhilerevalidate", 60, "Seconds an expired image is served while it is refreshed")
+	PStaleError  = flag.Int("staleiferror", 86400, "Seconds an expired image is served while its origin fails")
+	POriginStale = flag.String("originstale", "", "Comma separated stale policies of origins as host=seconds/seconds")
 
 	OPaths = []string{"./", "./assets/", "../../assets/"}
 )
@@ -25,9 +73,15 @@ const (
 	OReadTimeout              = int(30) // HTTP read timeout in seconds
 	OWriteTimeout             = int(30) // HTTP write timeout in seconds
 	OShutdownTimeout          = int(60) // Server shutdown timeout in seconds
+	OFetchTimeout             = int(20) // Source image download timeout in seconds
+	OProcessTimeout           = int(20) // Image conversion timeout in seconds
+	OSendTimeout              = int(30) // Converted image write timeout in seconds
+	ORetryAfter               = int(5)  // Seconds clients are asked to wait when the server is busy
 	OMemoryGCInterval         = int(30) // Memory release inverval in seconds
 	OCacheConvertedDir        = "resized"
+	OCacheTilesDir            = "tiles"
 	OFileCacheHeaderExtension = "header"
+	OSaveDataQuality          = int(50) // Output quality used when client sends Save-Data: on
 )
 
 const (
@@ -35,7 +89,9 @@ const (
 	EnvAddr       = "IMGRESIZR_ADDR"
 	EnvFCacheSize = "IMGRESIZR_FCASHESIZE"
 	EnvMCacheSize = "IMGRESIZR_MCASHESIZE"
+	EnvTCacheSize = "IMGRESIZR_TCASHESIZE"
 	EnvLogLevel   = "IMGRESIZR_LOGLEVEL"
+	EnvThumborKey = "IMGRESIZR_THUMBORKEY"
 
 	Usage = `imgresizr %s
 
@@ -47,17 +103,79 @@ Options:
    -p <port>                             bind port [default: 9000]
    -cf <cache_size>                      how many images to keep in filesystem as a cache [default: 2]
    -cm <cache_size>                      how many images to keep in memory as a cache [default: 1]
+   -ct <cache_size>                      how many deep zoom tiles to keep in filesystem as a cache [default: 100]
    -cp <cache_path>                      where would the cache for images be located [default: ./cache]
    -h, -help                             output help
    -v, -version                          output version
    -errorimage <path_to_image>           image to use on error
+   -notfoundimage <path_to_image>        image to use when the source is not found [default: -errorimage]
+   -badimageimage <path_to_image>        image to use when the source is not a valid image [default: -errorimage]
+   -timeoutimage <path_to_image>         image to use when the source download timed out [default: -errorimage]
+   -noerrorimage                         answer errors with the message as text instead of an image [default: false]
    -loglevel <level>                     log level (1 - debug, 2 - info, 3 - warn, 4 - error) [default: warn]
+   -svg                                  allow SVG source images, rasterized at the requested size [default: false]
+   -pdf                                  allow PDF source documents, page chosen with ?page=N [default: false]
+   -maxdpr <ratio>                       maximum device pixel ratio for ?dpr=N [default: 3]
+   -clienthints                          use Sec-CH-DPR, Sec-CH-Width, Sec-CH-Viewport-Width and Save-Data
+                                         request headers for sizing and quality [default: false]
+   -fontpath <path>                      directory with .ttf/.otf fonts for text overlays, without one every
+                                         text is written with the built in font [default: none]
+   -thumbor                              accept thumbor URLs like /unsafe/300x200/smart/host/img.jpg [default: false]
+   -thumborkey <key>                     key thumbor URLs are signed with, when set unsafe URLs are rejected
+   -carvemaxpixels <pixels>              maximum pixels the seam carving carve operation works on, larger
+                                         sources are scaled down first [default: 250000]
+   -engine <name>                        image processing engine, bimg (libvips) or go (pure Go, no SVG/PDF
+                                         sources and no WEBP output) [default: bimg when built with cgo]
+   -maxsourcebytes <bytes>               maximum size of a downloaded source image, larger downloads are
+                                         aborted, 0 for no limit [default: 52428800]
+   -maxsourcepixels <pixels>             maximum width times height of a source image, checked before it is
+                                         decoded, 0 for no limit [default: 100000000]
+   -maxwidth <pixels>                    maximum width of a resized image, 0 for no limit [default: 10000]
+   -maxheight <pixels>                   maximum height of a resized image, 0 for no limit [default: 10000]
+   -maxarea <pixels>                     maximum width times height of a resized image, 0 for no limit
+                                         [default: 50000000]
+   -workers <count>                      maximum conversions running at once, 0 for no limit
+                                         [default: number of cores]
+   -queue <count>                        maximum conversions waiting for a worker, when full requests get
+                                         503 with Retry-After [default: 100]
+   -queuetimeout <seconds>               how long a conversion may wait for a worker before 503 [default: 10]
+   -prioritize                           small thumbnails skip ahead of large renders in the queue
+                                         [default: false]
+   -idleconns <count>                    maximum idle connections to source servers [default: 100]
+   -idleconnsperhost <count>             maximum idle connections per source server [default: 10]
+   -connsperhost <count>                 maximum connections per source server, 0 for no limit [default: 0]
+   -idletimeout <seconds>                how long an idle connection is kept [default: 90]
+   -dialtimeout <seconds>                how long connecting to a source server may take [default: 10]
+   -tlstimeout <seconds>                 how long the TLS handshake may take [default: 10]
+   -cafile <path>                        PEM bundle of CA certificates trusted in addition to the system ones
+   -insecurehosts <host,host>            source hosts whose certificates are not verified
+   -nohttp2                              do not use HTTP/2 for source downloads [default: false]
+   -proxy <url>                          http://, https:// or socks5:// proxy for source downloads, the
+                                         HTTP_PROXY and HTTPS_PROXY variables are used if not set
+   -useragent <agent>                    User-Agent of source downloads, empty passes the one of the client
+                                         [default: imgresizr/<version>]
+   -retries <count>                      retries of source downloads failing to connect or answering 502, 503
+                                         or 504, with jittered exponential backoff [default: 2]
+   -retrybackoff <milliseconds>          delay before the first retry, doubled for every next one [default: 100]
+   -breakerfailures <count>              consecutive failures after which downloads from a host fail fast,
+                                         0 disables the circuit breaker, state is shown at /status [default: 5]
+   -breakercooldown <seconds>            how long downloads from a host fail fast before a probe [default: 30]
+   -mincachettl <seconds>                minimum time a cached source image is used before it is revalidated,
+                                         overrides shorter origin Cache-Control and Expires [default: 60]
+   -maxcachettl <seconds>                maximum time a cached source image is used before it is revalidated,
+                                         also used when the origin gives none, 0 for no limit [default: 0]
+   -stalewhilerevalidate <seconds>       how long past its expiry an image is served right away while it is
+                                         refreshed in the background, 0 disables [default: 60]
+   -staleiferror <seconds>               how long past its expiry an image is served when its origin fails or
+                                         times out, 0 disables [default: 86400]
+   -originstale <host=seconds/seconds>   comma separated stale-while-revalidate/stale-if-error seconds of
+                                         origins overriding the ones above, e.g. cdn.example.com=0/3600
 
 Other:
    On this machine will use %d cores
 
 Note:  
-   Environment variables '%s', '%s', '%s', '%s', '%s' can be set prior 
+   Environment variables '%s', '%s', '%s', '%s', '%s', '%s', '%s' can be set prior 
    to execution to override whatever values were provided on command line
    
    To test in browser put:
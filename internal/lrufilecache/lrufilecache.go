@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/Dmit1812/imgresizr/internal/config"
 	"github.com/Dmit1812/imgresizr/pkg/lrucache"
@@ -27,6 +28,12 @@ type LRUFileCache struct {
 type CacheItem struct {
 	Headers http.Header `json:"headers"`
 	Content []byte      `json:"-"`
+	Expires time.Time   `json:"expires"` // the item is kept until evicted if zero
+}
+
+// Expired tells whether the item is past its expiry and should be revalidated.
+func (ci CacheItem) Expired(now time.Time) bool {
+	return !ci.Expires.IsZero() && !now.Before(ci.Expires)
 }
 
 type Logger interface {
@@ -134,7 +141,12 @@ func (c *LRUFileCache) loadFile(name string) (CacheItem, error) {
 
 	jsonData, _ = os.ReadFile(filenameH)
 
-	err = json.Unmarshal(jsonData, &ci.Headers)
+	err = json.Unmarshal(jsonData, &ci)
+	if err != nil || ci.Headers == nil {
+		// files saved before the expiry was kept hold only the headers
+		ci.Expires = time.Time{}
+		err = json.Unmarshal(jsonData, &ci.Headers)
+	}
 	if err != nil {
 		c.Log.Error(err.Error())
 
@@ -148,7 +160,7 @@ func (c *LRUFileCache) saveFile(name string, ci CacheItem) error {
 	filename := path.Join(c.basepath, name)
 	filenameH := filename + "." + headerExtension
 
-	jsonData, err := json.Marshal(ci.Headers)
+	jsonData, err := json.Marshal(ci)
 	if err != nil {
 		c.Log.Error(err.Error())
 		return err
@@ -184,9 +196,8 @@ func (c *LRUFileCache) Set(uri string, ci CacheItem) bool {
 func (c *LRUFileCache) setByHash(key string, ci CacheItem) bool {
 	mfound := c.mcache.Set(key, ci)
 	ffound := c.fcache.Set(key, "")
-	if !ffound {
-		c.saveFile(key, ci)
-	}
+	// an item set again may have been refetched or revalidated so the file is always written
+	c.saveFile(key, ci)
 	return mfound || ffound
 }
 
@@ -0,0 +1,583 @@
+package internalhttp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+
+	"golang.org/x/image/webp"
+)
+
+const (
+	gifHeaderSize      = 13 // signature and logical screen descriptor
+	gifDescriptorSize  = 10
+	gifExtension       = 0x21
+	gifImageDescriptor = 0x2c
+
+	webpFlagAnimation   = 0x02
+	webpFlagAlpha       = 0x10
+	webpFrameNoBlend    = 0x02
+	webpFrameDispose    = 0x01
+	webpFrameHeaderSize = 16
+)
+
+var (
+	gifSignature = []byte("GIF8")
+
+	errNoWebPFrame = errors.New("no frame data found in encoded webp image")
+	errInvalidWebP = errors.New("invalid webp image")
+)
+
+// animation is a decoded animated image with its frames coalesced onto the full canvas,
+// so every frame can be processed on its own.
+type animation struct {
+	format    ImageType       // GIF or WEBP, the format of the source
+	frames    []*image.RGBA   // coalesced frames
+	delays    []int           // frame delays in hundredths of a second as in GIF
+	loopCount int             // as in GIF: -1 plays once, 0 forever, n repeats n times
+	palettes  []color.Palette // palettes of the source GIF frames, nil for WebP
+}
+
+// decodeAnimation returns the animation if the image is an animated GIF or WebP and nil otherwise.
+func decodeAnimation(buf []byte) *animation {
+	if frames, _ := animationFrames(buf); frames < 2 {
+		// still images are left to the engine rather than decoded here
+		return nil
+	}
+	switch {
+	case bytes.HasPrefix(buf, gifSignature):
+		g, err := gif.DecodeAll(bytes.NewReader(buf))
+		if err != nil || len(g.Image) < 2 {
+			return nil
+		}
+		return gifAnimation(g)
+	case isAnimatedWebP(buf):
+		anim, err := decodeAnimatedWebP(buf)
+		if err != nil || len(anim.frames) < 2 {
+			return nil
+		}
+		return anim
+	}
+	return nil
+}
+
+// animationFrames returns the number of frames and the canvas size of a GIF or an animated WebP
+// read from the headers alone, no pixels are decoded. Other images have no frames.
+func animationFrames(buf []byte) (int, image.Point) {
+	switch {
+	case bytes.HasPrefix(buf, gifSignature):
+		return gifFrames(buf)
+	case isAnimatedWebP(buf):
+		return webpFrames(buf)
+	}
+	return 0, image.Point{}
+}
+
+// gifFrames counts the image descriptors of the GIF skipping the data blocks between them.
+func gifFrames(buf []byte) (int, image.Point) {
+	if len(buf) < gifHeaderSize {
+		return 0, image.Point{}
+	}
+	canvas := image.Rect(0, 0, int(binary.LittleEndian.Uint16(buf[6:])), int(binary.LittleEndian.Uint16(buf[8:])))
+	var bounds image.Rectangle
+	frames := 0
+	for pos := gifHeaderSize + gifColorTableSize(buf[10]); pos < len(buf); {
+		switch buf[pos] {
+		case gifExtension:
+			pos = skipGIFBlocks(buf, pos+2)
+		case gifImageDescriptor:
+			if pos+gifDescriptorSize > len(buf) {
+				return frames, canvas.Size()
+			}
+			x, y := int(binary.LittleEndian.Uint16(buf[pos+1:])), int(binary.LittleEndian.Uint16(buf[pos+3:]))
+			w, h := int(binary.LittleEndian.Uint16(buf[pos+5:])), int(binary.LittleEndian.Uint16(buf[pos+7:]))
+			bounds = bounds.Union(image.Rect(x, y, x+w, y+h))
+			frames++
+			// the local color table and the LZW code size come before the data blocks
+			pos = skipGIFBlocks(buf, pos+gifDescriptorSize+gifColorTableSize(buf[pos+9])+1)
+		default:
+			// the trailer
+			pos = len(buf)
+		}
+	}
+	if canvas.Empty() {
+		// the frames are drawn onto their union as in coalesceFrames
+		canvas = bounds
+	}
+	return frames, canvas.Size()
+}
+
+// gifColorTableSize returns the size of the color table the packed fields announce.
+func gifColorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << (flags&0x07 + 1)
+}
+
+// skipGIFBlocks returns the position after the data sub-blocks starting at pos.
+func skipGIFBlocks(buf []byte, pos int) int {
+	for pos < len(buf) && buf[pos] != 0 {
+		pos += int(buf[pos]) + 1
+	}
+	return pos + 1
+}
+
+// webpFrames counts the frame chunks of the animated WebP.
+func webpFrames(buf []byte) (int, image.Point) {
+	frames, canvas := 0, image.Point{}
+	_ = readRIFFChunks(buf[12:], func(fourcc string, payload []byte) error {
+		switch {
+		case fourcc == "VP8X" && len(payload) >= 10:
+			canvas = image.Pt(readUint24(payload[4:])+1, readUint24(payload[7:])+1)
+		case fourcc == "ANMF":
+			frames++
+		}
+		return nil
+	})
+	return frames, canvas
+}
+
+func gifAnimation(g *gif.GIF) *animation {
+	anim := &animation{format: GIF, frames: coalesceFrames(g, len(g.Image)), loopCount: g.LoopCount}
+	for i, frame := range g.Image {
+		anim.delays = append(anim.delays, frameDelay(g, i))
+		anim.palettes = append(anim.palettes, frame.Palette)
+	}
+	return anim
+}
+
+// keepsAnimation reports whether the requested output format is able to hold all the frames.
+func keepsAnimation(opts Options) bool {
+	return opts.Frame == 0 && (opts.Format == UNKNOWN || opts.Format == GIF || opts.Format == WEBP)
+}
+
+// resizeAnimated resizes every frame of the animation, applies the effects to it and puts
+// the frames back together keeping the frame delays and the loop count. The result has the format
+// of the source unless GIF or WebP was requested as output format.
+func resizeAnimated(anim *animation, opts Options) ([]byte, error) {
+	if opts.Format == UNKNOWN {
+		opts.Format = anim.format
+	}
+	params := engineOptions(opts)
+	// trim is calculated per frame and would make frames differ in size
+	params.Trim = false
+	params.Type = PNG
+
+	frames := append([]*image.RGBA(nil), anim.frames...)
+	if opts.Extract.isSet() {
+		bounds := frames[0].Bounds()
+		rect, err := opts.Extract.rect(bounds.Dx(), bounds.Dy())
+		if err != nil {
+			return []byte{}, err
+		}
+		for i, frame := range frames {
+			frames[i], _ = frame.SubImage(rect.Add(bounds.Min)).(*image.RGBA)
+		}
+	}
+
+	resized := make([][]byte, 0, len(frames))
+	for _, frame := range frames {
+		buf, err := encodePNG(frame)
+		if err != nil {
+			return []byte{}, err
+		}
+		buf, err = processingEngine().Resize(buf, params)
+		if err != nil {
+			return []byte{}, err
+		}
+		if opts.hasEffects() || opts.Format == WEBP {
+			buf, err = finishFrame(buf, opts)
+			if err != nil {
+				return []byte{}, err
+			}
+		}
+		resized = append(resized, buf)
+	}
+
+	if opts.Format == WEBP {
+		return encodeAnimatedWebP(anim, resized)
+	}
+	return encodeAnimatedGIF(anim, resized, opts)
+}
+
+// finishFrame applies the effects to the resized PNG frame and converts it to the frame format.
+func finishFrame(buf []byte, opts Options) ([]byte, error) {
+	format := PNG
+	if opts.Format == WEBP {
+		format = WEBP
+	}
+	if !opts.hasEffects() {
+		return processingEngine().Resize(buf, EngineOptions{Type: format, Quality: opts.Quality})
+	}
+	result, err := applyEffects(buf, opts)
+	if err != nil {
+		return nil, err
+	}
+	// frames of animated GIFs are quantized when the animation is put together
+	opts.Palette = 0
+	return encodeImage(result, format, opts)
+}
+
+// extractFrame renders the n-th (1-based) frame of the animation as a still PNG image.
+func extractFrame(anim *animation, n int) ([]byte, error) {
+	if n > len(anim.frames) {
+		return nil, fmt.Errorf("%w: (frame=%d) (frames=%d)", ErrOutOfRange, n, len(anim.frames))
+	}
+	return encodePNG(anim.frames[n-1])
+}
+
+// coalesceFrames renders the first n frames onto the full canvas applying the disposal
+// methods, so every returned frame can be processed on its own.
+func coalesceFrames(g *gif.GIF, n int) []*image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(bounds)
+	frames := make([]*image.RGBA, 0, n)
+	for i := 0; i < n; i++ {
+		frame := g.Image[i]
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneRGBA(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeAnimatedGIF builds a GIF out of the resized PNG frames using the timings of the source
+// animation. Frames keep their source palettes unless quantization was requested, frames of
+// WebP sources are quantized.
+func encodeAnimatedGIF(anim *animation, frames [][]byte, opts Options) ([]byte, error) {
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(frames)),
+		Delay:     make([]int, 0, len(frames)),
+		Disposal:  make([]byte, 0, len(frames)),
+		LoopCount: anim.loopCount,
+	}
+
+	for i, buf := range frames {
+		img, err := png.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return []byte{}, fmt.Errorf("unable to decode resized frame: %w", err)
+		}
+
+		var frame *image.Paletted
+		switch {
+		case opts.Palette > 0:
+			frame = quantize(img, opts.Palette, opts.Dither)
+		case anim.palettes == nil:
+			frame = quantize(img, maxPaletteColors, opts.Dither)
+		default:
+			frame = image.NewPaletted(img.Bounds(), framePalette(anim.palettes[i]))
+			draw.FloydSteinberg.Draw(frame, frame.Bounds(), img, img.Bounds().Min)
+		}
+
+		out.Image = append(out.Image, frame)
+		out.Delay = append(out.Delay, anim.delays[i])
+		// frames are coalesced so each one replaces the previous completely
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, out)
+	if err != nil {
+		return []byte{}, fmt.Errorf("unable to encode animated gif: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// framePalette returns the palette of the source frame with a transparent color added if there was none.
+func framePalette(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	if len(p) < 256 {
+		return append(p[:len(p):len(p)], color.Transparent)
+	}
+	return p
+}
+
+func frameDelay(g *gif.GIF, i int) int {
+	if i < len(g.Delay) {
+		return g.Delay[i]
+	}
+	return 0
+}
+
+// encodeAnimatedWebP muxes the resized WebP frames into an animated WebP container.
+func encodeAnimatedWebP(anim *animation, frames [][]byte) ([]byte, error) {
+	var body bytes.Buffer
+	var canvasWidth, canvasHeight int
+	var flags byte = webpFlagAnimation
+
+	for i, buf := range frames {
+		frame, err := parseWebPFrame(buf)
+		if err != nil {
+			return []byte{}, err
+		}
+		if i == 0 {
+			canvasWidth, canvasHeight = frame.width, frame.height
+		}
+		if frame.alpha {
+			flags |= webpFlagAlpha
+		}
+
+		var anmf bytes.Buffer
+		anmf.Write(uint24(0)) // frame X offset / 2
+		anmf.Write(uint24(0)) // frame Y offset / 2
+		anmf.Write(uint24(frame.width - 1))
+		anmf.Write(uint24(frame.height - 1))
+		// gif delays are in hundredths of a second, webp durations in milliseconds
+		anmf.Write(uint24(anim.delays[i] * 10))
+		anmf.WriteByte(webpFrameNoBlend)
+		anmf.Write(frame.chunks)
+		writeRIFFChunk(&body, "ANMF", anmf.Bytes())
+	}
+
+	var vp8x bytes.Buffer
+	vp8x.Write([]byte{flags, 0, 0, 0})
+	vp8x.Write(uint24(canvasWidth - 1))
+	vp8x.Write(uint24(canvasHeight - 1))
+
+	animChunk := make([]byte, 6)
+	binary.LittleEndian.PutUint16(animChunk[4:], webpLoopCount(anim.loopCount))
+
+	var chunks bytes.Buffer
+	writeRIFFChunk(&chunks, "VP8X", vp8x.Bytes())
+	writeRIFFChunk(&chunks, "ANIM", animChunk)
+	chunks.Write(body.Bytes())
+	return webpContainer(chunks.Bytes()), nil
+}
+
+// webpContainer wraps the chunks into the RIFF container of a WebP image.
+func webpContainer(chunks []byte) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(chunks)+12))
+	out.WriteString("RIFF")
+	_ = binary.Write(out, binary.LittleEndian, uint32(len(chunks)+4))
+	out.WriteString("WEBP")
+	out.Write(chunks)
+	return out.Bytes()
+}
+
+// gifLoopCount converts webp loop count (0 forever, n play n times) to gif loop count.
+func gifLoopCount(webpLoopCount uint16) int {
+	switch webpLoopCount {
+	case 0:
+		return 0
+	case 1:
+		return -1
+	default:
+		return int(webpLoopCount) - 1
+	}
+}
+
+// webpLoopCount converts gif loop count (-1 play once, 0 forever, n repeat n times)
+// to webp loop count (0 forever, n play n times).
+func webpLoopCount(gifLoopCount int) uint16 {
+	switch {
+	case gifLoopCount < 0:
+		return 1
+	case gifLoopCount == 0:
+		return 0
+	default:
+		return uint16(gifLoopCount + 1)
+	}
+}
+
+type webpFrame struct {
+	chunks        []byte
+	width, height int
+	alpha         bool
+}
+
+// parseWebPFrame extracts the image data chunks and the dimensions of a still WebP image.
+func parseWebPFrame(buf []byte) (webpFrame, error) {
+	var frame webpFrame
+	if len(buf) < 12 || string(buf[0:4]) != "RIFF" || string(buf[8:12]) != "WEBP" {
+		return frame, errNoWebPFrame
+	}
+
+	var chunks bytes.Buffer
+	err := readRIFFChunks(buf[12:], func(fourcc string, payload []byte) error {
+		switch fourcc {
+		case "ALPH":
+			frame.alpha = true
+			writeRIFFChunk(&chunks, fourcc, payload)
+		case "VP8 ":
+			if len(payload) < 10 {
+				return errNoWebPFrame
+			}
+			frame.width = int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff)
+			frame.height = int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff)
+			writeRIFFChunk(&chunks, fourcc, payload)
+		case "VP8L":
+			if len(payload) < 5 {
+				return errNoWebPFrame
+			}
+			bits := binary.LittleEndian.Uint32(payload[1:5])
+			frame.width = int(bits&0x3fff) + 1
+			frame.height = int((bits>>14)&0x3fff) + 1
+			frame.alpha = frame.alpha || (bits>>28)&1 == 1
+			writeRIFFChunk(&chunks, fourcc, payload)
+		}
+		return nil
+	})
+	if err != nil || chunks.Len() == 0 || frame.width == 0 || frame.height == 0 {
+		return frame, errNoWebPFrame
+	}
+	frame.chunks = chunks.Bytes()
+	return frame, nil
+}
+
+// isAnimatedWebP reports whether the image is an extended WebP with the animation flag set.
+func isAnimatedWebP(buf []byte) bool {
+	return len(buf) > 20 && string(buf[0:4]) == "RIFF" && string(buf[8:16]) == "WEBPVP8X" &&
+		buf[20]&webpFlagAnimation != 0
+}
+
+// decodeAnimatedWebP decodes the frames of an animated WebP and coalesces them onto its canvas
+// applying their blending and disposal methods.
+func decodeAnimatedWebP(buf []byte) (*animation, error) {
+	anim := &animation{format: WEBP}
+	var canvas *image.RGBA
+	err := readRIFFChunks(buf[12:], func(fourcc string, payload []byte) error {
+		switch fourcc {
+		case "VP8X":
+			if len(payload) < 10 {
+				return errInvalidWebP
+			}
+			canvas = image.NewRGBA(image.Rect(0, 0, readUint24(payload[4:])+1, readUint24(payload[7:])+1))
+		case "ANIM":
+			if len(payload) < 6 {
+				return errInvalidWebP
+			}
+			anim.loopCount = gifLoopCount(binary.LittleEndian.Uint16(payload[4:6]))
+		case "ANMF":
+			if canvas == nil || len(payload) < webpFrameHeaderSize {
+				return errInvalidWebP
+			}
+			x, y := 2*readUint24(payload[0:]), 2*readUint24(payload[3:])
+			width, height := readUint24(payload[6:])+1, readUint24(payload[9:])+1
+			frame, err := decodeWebPFrame(payload[webpFrameHeaderSize:], width, height)
+			if err != nil {
+				return err
+			}
+
+			op := draw.Over
+			if payload[15]&webpFrameNoBlend != 0 {
+				op = draw.Src
+			}
+			rect := image.Rect(x, y, x+width, y+height)
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, op)
+			anim.frames = append(anim.frames, cloneRGBA(canvas))
+			// webp durations are in milliseconds, gif delays in hundredths of a second
+			anim.delays = append(anim.delays, (readUint24(payload[12:])+5)/10)
+			if payload[15]&webpFrameDispose != 0 {
+				draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+		return nil
+	})
+	return anim, err
+}
+
+// decodeWebPFrame decodes the image data chunks of an animation frame as a still WebP image.
+func decodeWebPFrame(chunks []byte, width, height int) (image.Image, error) {
+	alpha := false
+	err := readRIFFChunks(chunks, func(fourcc string, _ []byte) error {
+		alpha = alpha || fourcc == "ALPH"
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var still bytes.Buffer
+	if alpha {
+		// the alpha chunk is only allowed in the extended format
+		vp8x := append([]byte{webpFlagAlpha, 0, 0, 0}, uint24(width-1)...)
+		writeRIFFChunk(&still, "VP8X", append(vp8x, uint24(height-1)...))
+	}
+	still.Write(chunks)
+	img, err := webp.Decode(bytes.NewReader(webpContainer(still.Bytes())))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode webp frame: %w", err)
+	}
+	return img, nil
+}
+
+// readRIFFChunks calls fn with every chunk of the RIFF data.
+func readRIFFChunks(buf []byte, fn func(fourcc string, payload []byte) error) error {
+	for pos := 0; pos+8 <= len(buf); {
+		size := int(binary.LittleEndian.Uint32(buf[pos+4 : pos+8]))
+		start, end := pos+8, pos+8+size
+		if size < 0 || end > len(buf) {
+			return errInvalidWebP
+		}
+		if err := fn(string(buf[pos:pos+4]), buf[start:end]); err != nil {
+			return err
+		}
+		pos = end + size%2
+	}
+	return nil
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, fourcc string, payload []byte) {
+	buf.WriteString(fourcc)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func uint24(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+func readUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
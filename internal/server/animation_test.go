@@ -0,0 +1,234 @@
+package internalhttp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// build a 4x4 animation where the second frame only covers the top left pixel.
+func testAnimation(disposal byte) *gif.GIF {
+	pal := color.Palette{color.Black, color.White, color.Transparent}
+	first := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+	for i := range first.Pix {
+		first.Pix[i] = 1
+	}
+	second := image.NewPaletted(image.Rect(0, 0, 1, 1), pal)
+	third := image.NewPaletted(image.Rect(3, 3, 4, 4), pal)
+
+	return &gif.GIF{
+		Image:    []*image.Paletted{first, second, third},
+		Delay:    []int{10, 20, 30},
+		Disposal: []byte{gif.DisposalNone, disposal, gif.DisposalNone},
+		Config:   image.Config{Width: 4, Height: 4},
+	}
+}
+
+func TestCoalesceFrames(t *testing.T) {
+	t.Parallel()
+	white := color.RGBA{255, 255, 255, 255}
+	black := color.RGBA{0, 0, 0, 255}
+
+	tests := []struct {
+		name     string
+		disposal byte
+		topLeft  color.RGBA // top left pixel of the third frame
+	}{
+		{name: "none", disposal: gif.DisposalNone, topLeft: black},
+		{name: "background", disposal: gif.DisposalBackground, topLeft: color.RGBA{}},
+		{name: "previous", disposal: gif.DisposalPrevious, topLeft: white},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			frames := coalesceFrames(testAnimation(tc.disposal), 3)
+			require.Len(t, frames, 3)
+			for _, f := range frames {
+				require.Equal(t, image.Rect(0, 0, 4, 4), f.Bounds(), "every frame should cover the canvas")
+			}
+			require.Equal(t, white, frames[0].RGBAAt(0, 0))
+			require.Equal(t, black, frames[1].RGBAAt(0, 0))
+			require.Equal(t, tc.topLeft, frames[2].RGBAAt(0, 0))
+			require.Equal(t, black, frames[2].RGBAAt(3, 3))
+		})
+	}
+}
+
+func TestAnimationFrames(t *testing.T) {
+	t.Parallel()
+	var animated, still bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&animated, testAnimation(gif.DisposalNone)))
+	require.NoError(t, gif.Encode(&still, image.NewPaletted(image.Rect(0, 0, 5, 3), palette.Plan9), nil))
+	red := color.NRGBA{R: 255, A: 255}
+	webpSource, err := encodeAnimatedWebP(&animation{delays: []int{10, 20}},
+		[][]byte{solidWebP(6, 2, red), solidWebP(6, 2, red)})
+	require.NoError(t, err)
+
+	tests := []struct {
+		buf    []byte
+		frames int
+		size   image.Point
+	}{
+		{buf: animated.Bytes(), frames: 3, size: image.Pt(4, 4)},
+		{buf: still.Bytes(), frames: 1, size: image.Pt(5, 3)},
+		{buf: webpSource, frames: 2, size: image.Pt(6, 2)},
+		{buf: solidWebP(6, 2, red)},
+		{buf: []byte("GIF89a")},
+	}
+
+	for i, tc := range tests {
+		frames, size := animationFrames(tc.buf)
+		require.Equal(t, tc.frames, frames, i)
+		require.Equal(t, tc.size, size, i)
+	}
+}
+
+func TestExtractFrameOutOfRange(t *testing.T) {
+	t.Parallel()
+	_, err := extractFrame(gifAnimation(testAnimation(gif.DisposalNone)), 4)
+	require.Error(t, err)
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	t.Parallel()
+	// a lossless frame header for a 3x2 image with alpha, the bitstream itself is not inspected
+	vp8l := []byte{0x2f, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(vp8l[1:5], (3-1)|(2-1)<<14|1<<28)
+	var still bytes.Buffer
+	writeRIFFChunk(&still, "VP8L", vp8l)
+	frame := append([]byte("RIFF\x00\x00\x00\x00WEBP"), still.Bytes()...)
+
+	anim := testAnimation(gif.DisposalNone)
+	anim.LoopCount = 2
+	out, err := encodeAnimatedWebP(gifAnimation(anim), [][]byte{frame, frame, frame})
+	require.NoError(t, err)
+
+	require.Equal(t, "RIFF", string(out[0:4]))
+	require.Equal(t, uint32(len(out)-8), binary.LittleEndian.Uint32(out[4:8]))
+	require.Equal(t, "WEBPVP8X", string(out[8:16]))
+	require.Equal(t, byte(webpFlagAnimation|webpFlagAlpha), out[20])
+	require.Equal(t, []byte{2, 0, 0, 1, 0, 0}, out[24:30], "canvas should be 3x2")
+	require.Equal(t, "ANIM", string(out[30:34]))
+	require.Equal(t, uint16(3), binary.LittleEndian.Uint16(out[42:44]), "loop count should be converted")
+	require.Equal(t, 3, bytes.Count(out, []byte("ANMF")))
+
+	// first frame duration is 10 hundredths of a second
+	require.Equal(t, uint24(100), out[44+8+12:44+8+15])
+}
+
+func TestWebPLoopCount(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, uint16(1), webpLoopCount(-1))
+	require.Equal(t, uint16(0), webpLoopCount(0))
+	require.Equal(t, uint16(4), webpLoopCount(3))
+}
+
+// solidWebP returns a lossless WebP image of a single color. Each of its prefix codes has a single symbol,
+// so the pixels take no bits at all.
+func solidWebP(width, height int, c color.NRGBA) []byte {
+	var bits []bool
+	write := func(v uint32, n int) {
+		for i := 0; i < n; i++ {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	write(uint32(width-1), 14)
+	write(uint32(height-1), 14)
+	write(1, 1) // alpha is used
+	write(0, 3) // version
+	write(0, 1) // no transform
+	write(0, 1) // no color cache
+	write(0, 1) // no meta prefix codes
+	for _, symbol := range []uint8{c.G, c.R, c.B, c.A, 0} {
+		write(1, 1) // simple code
+		write(0, 1) // of one symbol
+		write(1, 1) // of 8 bits
+		write(uint32(symbol), 8)
+	}
+
+	vp8l := make([]byte, 1+(len(bits)+7)/8)
+	vp8l[0] = 0x2f
+	for i, bit := range bits {
+		if bit {
+			vp8l[1+i/8] |= 1 << (i % 8)
+		}
+	}
+	var chunk bytes.Buffer
+	writeRIFFChunk(&chunk, "VP8L", vp8l)
+	return webpContainer(chunk.Bytes())
+}
+
+func TestDecodeAnimatedWebP(t *testing.T) {
+	t.Parallel()
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	anim := &animation{delays: []int{10, 20}, loopCount: -1}
+	buf, err := encodeAnimatedWebP(anim, [][]byte{solidWebP(4, 4, red), solidWebP(4, 4, blue)})
+	require.NoError(t, err)
+
+	decoded := decodeAnimation(buf)
+	require.NotNil(t, decoded)
+	require.Equal(t, WEBP, decoded.format)
+	require.Equal(t, []int{10, 20}, decoded.delays)
+	require.Equal(t, -1, decoded.loopCount)
+	require.Len(t, decoded.frames, 2)
+	require.Equal(t, color.RGBA{R: 255, A: 255}, decoded.frames[0].RGBAAt(3, 3))
+	require.Equal(t, color.RGBA{B: 255, A: 255}, decoded.frames[1].RGBAAt(3, 3))
+
+	require.Nil(t, decodeAnimation(solidWebP(4, 4, red)), "a still image is no animation")
+}
+
+func TestResizeAnimated(t *testing.T) {
+	t.Parallel()
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	webpSource, err := encodeAnimatedWebP(&animation{delays: []int{10, 20}, loopCount: 2},
+		[][]byte{solidWebP(40, 20, red), solidWebP(40, 20, blue)})
+	require.NoError(t, err)
+	var gifSource bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&gifSource, testAnimation(gif.DisposalNone)))
+
+	tests := []struct {
+		name   string
+		source []byte
+		w, h   int
+		delays []int
+		loop   int
+	}{
+		{name: "webp", source: webpSource, w: 20, h: 10, delays: []int{10, 20}, loop: 2},
+		{name: "gif", source: gifSource.Bytes(), w: 20, h: 20, delays: []int{10, 20, 30}},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			buf, err := Resize(tc.source, Options{Width: tc.w, Height: tc.h, Force: true, Format: GIF})
+			require.NoError(t, err)
+
+			out, err := gif.DecodeAll(bytes.NewReader(buf))
+			require.NoError(t, err)
+			require.Len(t, out.Image, len(tc.delays), "every frame should be kept")
+			require.Equal(t, tc.delays, out.Delay)
+			require.Equal(t, tc.loop, out.LoopCount)
+			for _, frame := range out.Image {
+				require.Equal(t, image.Rect(0, 0, tc.w, tc.h), frame.Bounds())
+			}
+		})
+	}
+
+	// a single frame is extracted as a still image
+	buf, err := Resize(webpSource, Options{Width: 20, Height: 10, Force: true, Frame: 2, Format: PNG})
+	require.NoError(t, err)
+	still, err := png.Decode(bytes.NewReader(buf))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 20, 10), still.Bounds())
+	require.Equal(t, color.NRGBAModel.Convert(blue), color.NRGBAModel.Convert(still.At(10, 5)))
+}
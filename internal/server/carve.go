@@ -0,0 +1,203 @@
+package internalhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+)
+
+const (
+	carveOperation = "carve"
+
+	// default limit of the pixels seam carving works on, the cost grows with pixels times seams.
+	defaultCarveMaxPixels = 250000
+)
+
+var ErrCarveTooLarge = errors.New("image is too large for seam carving")
+
+// carveImage resizes the image to the requested size removing the least noticeable seams
+// instead of cropping or stretching it. The source is first scaled to cover the size, if that
+// has more pixels than allowed the excess side is squeezed by scaling and only the rest is carved.
+// A non-empty area is carved instead of the whole source.
+func carveImage(buf []byte, opts Options, area image.Rectangle) ([]byte, error) {
+	width, height := opts.Width, opts.Height
+	if width <= 0 || height <= 0 {
+		// with one side free the aspect ratio is kept and there is nothing to carve
+		if area.Empty() {
+			return buf, nil
+		}
+		return processingEngine().Resize(buf, EngineOptions{Extract: area, Type: PNG})
+	}
+	// the size applies to the rotated result while carving happens before rotating
+	if opts.Rotate%180 != 0 {
+		width, height = height, width
+	}
+
+	limit := opts.CarveMaxPixels
+	if limit <= 0 {
+		limit = defaultCarveMaxPixels
+	}
+	if width*height > limit {
+		return nil, fmt.Errorf("%w: (size=%dx%d) (max pixels=%d)", ErrCarveTooLarge, width, height, limit)
+	}
+
+	size := ImageSize{Width: area.Dx(), Height: area.Dy()}
+	if area.Empty() {
+		var err error
+		if size, err = processingEngine().Size(buf); err != nil {
+			return nil, err
+		}
+	}
+	w, h := carveInputSize(size.Width, size.Height, width, height, limit)
+
+	buf, err := processingEngine().Resize(buf, EngineOptions{
+		Width: w, Height: h, Extract: area, Force: true, Enlarge: true, Type: PNG,
+	})
+	if err != nil {
+		return nil, err
+	}
+	src, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode scaled image: %w", err)
+	}
+	return encodePNG(seamCarve(toNRGBA(src), width, height))
+}
+
+// carveInputSize returns the size the source is scaled to before carving: covering the target
+// with the aspect ratio of the source, squeezed along the carved side to stay within limit pixels.
+func carveInputSize(srcWidth, srcHeight, width, height, limit int) (int, int) {
+	scale := math.Max(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+	w := max(width, int(math.Round(float64(srcWidth)*scale)))
+	h := max(height, int(math.Round(float64(srcHeight)*scale)))
+	if w*h > limit {
+		if w > width {
+			w = max(width, limit/h)
+		} else {
+			h = max(height, limit/w)
+		}
+	}
+	return w, h
+}
+
+// seamCarve removes vertical and then horizontal seams of the lowest energy until the image has the given size.
+func seamCarve(img *image.NRGBA, width, height int) *image.NRGBA {
+	g := newCarveGrid(img)
+	g.removeSeams(width)
+	g = g.transposed()
+	g.removeSeams(height)
+	return g.transposed().image()
+}
+
+// carveGrid holds the pixels of the image being carved, rows keep their original stride as they shrink.
+type carveGrid struct {
+	w, h, stride int
+	pix          []color.NRGBA
+}
+
+func newCarveGrid(img *image.NRGBA) *carveGrid {
+	b := img.Bounds()
+	g := &carveGrid{w: b.Dx(), h: b.Dy(), stride: b.Dx(), pix: make([]color.NRGBA, b.Dx()*b.Dy())}
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			g.pix[y*g.stride+x] = img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+		}
+	}
+	return g
+}
+
+func (g *carveGrid) transposed() *carveGrid {
+	t := &carveGrid{w: g.h, h: g.w, stride: g.h, pix: make([]color.NRGBA, g.w*g.h)}
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			t.pix[x*t.stride+y] = g.pix[y*g.stride+x]
+		}
+	}
+	return t
+}
+
+func (g *carveGrid) image() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, g.w, g.h))
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			img.SetNRGBA(x, y, g.pix[y*g.stride+x])
+		}
+	}
+	return img
+}
+
+// energy returns the gradient magnitude of the luminance at every pixel.
+func (g *carveGrid) energy() []float64 {
+	lum := make([]float64, g.w*g.h)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			c := g.pix[y*g.stride+x]
+			lum[y*g.w+x] = (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) * float64(c.A) / 255
+		}
+	}
+
+	e := make([]float64, g.w*g.h)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			left, right := lum[y*g.w+max(x-1, 0)], lum[y*g.w+min(x+1, g.w-1)]
+			up, down := lum[max(y-1, 0)*g.w+x], lum[min(y+1, g.h-1)*g.w+x]
+			e[y*g.w+x] = math.Abs(right-left) + math.Abs(down-up)
+		}
+	}
+	return e
+}
+
+// removeSeams removes vertical seams until the grid is width pixels wide.
+func (g *carveGrid) removeSeams(width int) {
+	for g.w > width && g.w > 1 {
+		g.removeSeam(g.findSeam())
+	}
+}
+
+// findSeam returns the column of every row on the connected vertical path with the lowest total energy.
+func (g *carveGrid) findSeam() []int {
+	cost := g.energy()
+	for y := 1; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			above := cost[(y-1)*g.w+x]
+			if x > 0 {
+				above = math.Min(above, cost[(y-1)*g.w+x-1])
+			}
+			if x < g.w-1 {
+				above = math.Min(above, cost[(y-1)*g.w+x+1])
+			}
+			cost[y*g.w+x] += above
+		}
+	}
+
+	seam := make([]int, g.h)
+	last := (g.h - 1) * g.w
+	for x := 1; x < g.w; x++ {
+		if cost[last+x] < cost[last+seam[g.h-1]] {
+			seam[g.h-1] = x
+		}
+	}
+	// walk back up following the cheapest neighbour
+	for y := g.h - 2; y >= 0; y-- {
+		next := seam[y+1]
+		best := next
+		for _, x := range []int{next - 1, next + 1} {
+			if x >= 0 && x < g.w && cost[y*g.w+x] < cost[y*g.w+best] {
+				best = x
+			}
+		}
+		seam[y] = best
+	}
+	return seam
+}
+
+func (g *carveGrid) removeSeam(seam []int) {
+	for y, x := range seam {
+		row := g.pix[y*g.stride : y*g.stride+g.w]
+		copy(row[x:], row[x+1:])
+	}
+	g.w--
+}
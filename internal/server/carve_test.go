@@ -0,0 +1,126 @@
+package internalhttp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeamCarve(t *testing.T) {
+	t.Parallel()
+	// flat background with a block of stripes in the middle columns
+	background := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			c := background
+			if x >= 8 && x < 12 {
+				v := uint8(x-8) * 60
+				c = color.NRGBA{R: v, G: v, B: v, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	carved := seamCarve(img, 10, 8)
+	require.Equal(t, image.Rect(0, 0, 10, 8), carved.Bounds())
+
+	// the stripes survive as they are the part with the most energy
+	for y := 0; y < 8; y++ {
+		stripes := 0
+		for x := 0; x < 10; x++ {
+			if carved.NRGBAAt(x, y) != background {
+				stripes++
+			}
+		}
+		require.Equal(t, 4, stripes, "row %d", y)
+	}
+}
+
+func TestCarveInputSize(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		srcWidth, srcHeight, width, height, limit int
+		w, h                                      int
+	}{
+		{srcWidth: 1000, srcHeight: 1000, width: 400, height: 100, limit: 250000, w: 400, h: 400},
+		{srcWidth: 1000, srcHeight: 500, width: 100, height: 200, limit: 250000, w: 400, h: 200},
+		{srcWidth: 4000, srcHeight: 4000, width: 1000, height: 100, limit: 250000, w: 1000, h: 250},
+		{srcWidth: 100, srcHeight: 4000, width: 400, height: 400, limit: 250000, w: 400, h: 625},
+	}
+
+	for _, tc := range tests {
+		w, h := carveInputSize(tc.srcWidth, tc.srcHeight, tc.width, tc.height, tc.limit)
+		require.Equal(t, []int{tc.w, tc.h}, []int{w, h}, "%dx%d to %dx%d", tc.srcWidth, tc.srcHeight, tc.width, tc.height)
+		require.LessOrEqual(t, w*h, tc.limit)
+	}
+}
+
+func TestCarveImage(t *testing.T) {
+	t.Parallel()
+	// left half red, right half blue
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= 20 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	src, err := encodePNG(img)
+	require.NoError(t, err)
+
+	// only the area is carved
+	buf, err := carveImage(src, Options{Operation: carveOperation, Width: 10, Height: 8}, image.Rect(20, 0, 40, 20))
+	require.NoError(t, err)
+	out, _, err := decodeGo(buf)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 10, 8), out.Bounds())
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 10; x++ {
+			require.Equal(t, color.NRGBA{B: 255, A: 255}, out.NRGBAAt(x, y))
+		}
+	}
+
+	buf, err = carveImage(src, Options{Operation: carveOperation, Width: 10}, image.Rect(20, 0, 40, 20))
+	require.NoError(t, err)
+	size, err := GetImageSize(buf)
+	require.NoError(t, err)
+	require.Equal(t, ImageSize{Width: 20, Height: 20}, size, "the area should be cut out without carving")
+}
+
+func TestCarveImageTooLarge(t *testing.T) {
+	t.Parallel()
+	opts := Options{Operation: carveOperation, Width: 1000, Height: 1000, CarveMaxPixels: 1000}
+	_, err := carveImage(nil, opts, image.Rectangle{})
+	require.ErrorIs(t, err, ErrCarveTooLarge)
+}
+
+func TestResizeCarveFormat(t *testing.T) {
+	t.Parallel()
+	var src bytes.Buffer
+	require.NoError(t, jpeg.Encode(&src, image.NewNRGBA(image.Rect(0, 0, 40, 20)), nil))
+
+	tests := []struct {
+		format ImageType
+		want   ImageType
+	}{
+		{format: UNKNOWN, want: JPEG},
+		{format: PNG, want: PNG},
+	}
+
+	for _, tc := range tests {
+		buf, err := Resize(src.Bytes(), Options{Operation: carveOperation, Width: 10, Height: 8, Format: tc.format})
+		require.NoError(t, err)
+		require.Equal(t, tc.want, DetermineImageType(buf), "format %s", ImageTypes[tc.format])
+		size, err := GetImageSize(buf)
+		require.NoError(t, err)
+		require.Equal(t, ImageSize{Width: 10, Height: 8}, size)
+	}
+}
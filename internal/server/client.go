@@ -0,0 +1,124 @@
+package internalhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ClientConfig configures the HTTP client source images are downloaded with, zero values keep
+// the defaults of net/http.
+type ClientConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	CAFile              string   // PEM bundle trusted in addition to the system roots
+	InsecureHosts       []string // hosts whose certificates are not verified
+	DisableHTTP2        bool
+	Proxy               string // http, https or socks5 proxy URL, the proxy from the environment is used if empty
+}
+
+// NewHTTPClient creates the client for source downloads. Redirects are followed by the client,
+// timeouts of whole downloads come from the request context.
+func NewHTTPClient(cfg ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5") {
+			return nil, fmt.Errorf("invalid proxy URL provided: (proxy=%s)", cfg.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.DisableHTTP2 {
+		// a non-nil empty map turns HTTP/2 off
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	tlsConfig, err := clientTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if len(cfg.InsecureHosts) == 0 {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	// the insecure hosts get a transport of their own so every other host is still verified
+	insecure := transport.Clone()
+	insecure.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec // only for the configured hosts
+	hosts := make(map[string]bool, len(cfg.InsecureHosts))
+	for _, host := range cfg.InsecureHosts {
+		hosts[host] = true
+	}
+	return &http.Client{Transport: hostTransport{hosts: hosts, insecure: insecure, secure: transport}}, nil
+}
+
+// clientTLSConfig trusts the system roots and the CA bundle.
+func clientTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle: (file=%s)", cfg.CAFile)
+	}
+	tlsConfig.RootCAs = roots
+	return tlsConfig, nil
+}
+
+// hostTransport sends requests to the hosts whose certificates are not verified through the insecure transport.
+type hostTransport struct {
+	hosts    map[string]bool
+	insecure http.RoundTripper
+	secure   http.RoundTripper
+}
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hosts[req.URL.Hostname()] {
+		return t.insecure.RoundTrip(req)
+	}
+	return t.secure.RoundTrip(req)
+}
+
+func (o *Server) httpClient() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,56 @@
+package internalhttp
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.UserAgent()))
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o600)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		cfg     ClientConfig
+		invalid bool
+	}{
+		{name: "unknown CA", cfg: ClientConfig{}, invalid: true},
+		{name: "CA bundle", cfg: ClientConfig{CAFile: caFile}},
+		{name: "insecure host", cfg: ClientConfig{InsecureHosts: []string{"127.0.0.1"}}},
+		{name: "other insecure host", cfg: ClientConfig{InsecureHosts: []string{"example.com"}}, invalid: true},
+		{name: "HTTP/1.1 only", cfg: ClientConfig{CAFile: caFile, DisableHTTP2: true}},
+	}
+
+	for _, tc := range tests {
+		client, err := NewHTTPClient(tc.cfg)
+		require.NoError(t, err, tc.name)
+
+		o := &Server{HTTPReadTimeout: 5, Client: client, UserAgent: "imgresizr-test"}
+		body, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL, &http.Header{"User-Agent": {"browser"}})
+		if tc.invalid {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, "imgresizr-test", string(body), tc.name)
+	}
+
+	_, err = NewHTTPClient(ClientConfig{Proxy: "ftp://proxy"})
+	require.Error(t, err)
+	_, err = NewHTTPClient(ClientConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	require.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package internalhttp
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeImageCoalescesRequests(t *testing.T) {
+	t.Parallel()
+	var fetched int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		<-release
+		png, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+		w.Write(png)
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	opts := Options{Operation: "fill", Width: 10, Height: 10}
+	key := opts.cacheKey() + "-" + ts.URL
+
+	const requests = 10
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			o.serveImage(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/"+ts.URL, nil),
+				o.ConvertedImageCache, ts.URL, opts)
+			codes[i] = w.Code
+		}(i)
+	}
+	require.Eventually(t, func() bool { return o.conversions.Waiters(key) == requests }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetched), "the source should be fetched once")
+	for _, code := range codes {
+		require.Equal(t, codes[0], code, "every request should get the shared result")
+	}
+}
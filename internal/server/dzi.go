@@ -0,0 +1,249 @@
+package internalhttp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dziPrefix           = "/dzi/"
+	dziDescriptorSuffix = ".dzi"
+	dziFilesSuffix      = "_files/"
+	dziOperation        = "dzi"
+	dziLowOperation     = "dzilow"
+	dziNamespace        = "http://schemas.microsoft.com/deepzoom/2008"
+
+	dziTileSize = 254
+	dziOverlap  = 1
+	dziFormat   = "jpg"
+
+	// longest side of the downscaled source the tiles of the low levels are cut out of
+	dziBaseSize = 1024
+)
+
+var dziTileFormats = map[string]ImageType{
+	"jpg":  JPEG,
+	"jpeg": JPEG,
+	"png":  PNG,
+}
+
+// dziRequest is a request for the descriptor <url>.dzi or a tile <url>_files/{level}/{col}_{row}.{format}.
+type dziRequest struct {
+	URL             string
+	Descriptor      bool
+	Level, Col, Row int
+	Format          ImageType
+}
+
+type dziImage struct {
+	XMLName  xml.Name `xml:"Image"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Format   string   `xml:"Format,attr"`
+	Overlap  int      `xml:"Overlap,attr"`
+	TileSize int      `xml:"TileSize,attr"`
+	Size     dziSize  `xml:"Size"`
+}
+
+type dziSize struct {
+	Width  int `xml:"Width,attr"`
+	Height int `xml:"Height,attr"`
+}
+
+// dziRoute serves Deep Zoom descriptors and tiles. Tiles are cut lazily out of the cached
+// source image and kept in the tile cache.
+func (o *Server) dziRoute() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			o.Log.Error(fmt.Sprintf("unsupported method %s", r.Method))
+			o.failedRequest(w, r, "the method is not allowed")
+			return
+		}
+
+		req, err := parseDZIPath(r.URL.Path)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedRequest(w, r, err.Error())
+			return
+		}
+		if r.URL.RawQuery != "" {
+			// the query string belongs to the source image URL
+			req.URL += "?" + r.URL.RawQuery
+		}
+
+		size, err := o.getBaseImageSize(r.Context(), req.URL, &r.Header)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedSource(w, r, req.URL, err)
+			return
+		}
+
+		if req.Descriptor {
+			body, _ := xml.Marshal(dziImage{
+				Xmlns: dziNamespace, Format: dziFormat, Overlap: dziOverlap, TileSize: dziTileSize,
+				Size: dziSize{Width: size.Width, Height: size.Height},
+			})
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(xml.Header))
+			w.Write(body)
+			return
+		}
+
+		opts, err := req.options(size.Width, size.Height)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedRequest(w, r, err.Error())
+			return
+		}
+
+		o.Log.Info(fmt.Sprintf("will serve tile %d/%d_%d of image at %s", req.Level, req.Col, req.Row, req.URL))
+
+		if req.Level == dziMaxLevel(size.Width, size.Height) {
+			o.serveImage(w, r, o.tileCache(), req.URL, opts)
+			return
+		}
+		// the tiles of a lower level are cut out of the source downscaled once to the level rather
+		// than out of the full size source, the lowest levels share the one of dziBaseLevel
+		level := max(req.Level, dziBaseLevel(size.Width, size.Height))
+		levelWidth, levelHeight := dziLevelSize(size.Width, size.Height, level)
+		opts, _ = req.options(levelWidth, levelHeight)
+		opts.Operation = dziLowOperation
+		o.serveImageFrom(w, r, o.tileCache(), req.URL, opts, o.dziLevelImage(levelWidth, levelHeight))
+	}
+}
+
+// dziLevelImage returns the loader of the source downscaled to the size of a level, it is converted
+// once and kept in the tile cache.
+func (o *Server) dziLevelImage(width, height int) sourceLoader {
+	opts := Options{Operation: dziOperation, Width: width, Height: height, Force: true, NoTrim: true, Format: PNG}
+	return func(ctx context.Context, baseimagekey string, h *http.Header) (sharedResult, error) {
+		key := opts.cacheKey() + "-" + baseimagekey
+		cache := o.tileCache()
+		if ci, found := cache.Get(key); found && !ci.Expired(time.Now()) {
+			return sharedResult{image: ci.Content, headers: &ci.Headers, expires: ci.Expires}, nil
+		}
+		return o.conversions.Do(ctx, key, func(ctx context.Context) (sharedResult, error) {
+			return o.convertImage(ctx, cache, key, baseimagekey, h, opts, o.getBaseImage)
+		})
+	}
+}
+
+func (o *Server) tileCache() Cache {
+	if o.TileCache != nil {
+		return o.TileCache
+	}
+	return o.ConvertedImageCache
+}
+
+// parseDZIPath splits the request path into the source image URL and the requested descriptor or tile.
+func parseDZIPath(path string) (dziRequest, error) {
+	var req dziRequest
+	p := strings.TrimPrefix(path, dziPrefix)
+
+	if strings.HasSuffix(p, dziDescriptorSuffix) {
+		req.URL, req.Descriptor = strings.TrimSuffix(p, dziDescriptorSuffix), true
+		if req.URL == "" {
+			return req, fmt.Errorf("invalid deep zoom request: (path=%s)", path)
+		}
+		return req, nil
+	}
+
+	i := strings.LastIndex(p, dziFilesSuffix)
+	if i <= 0 {
+		return req, fmt.Errorf("invalid deep zoom request: (path=%s)", path)
+	}
+	req.URL = p[:i]
+
+	level, tile, found := strings.Cut(p[i+len(dziFilesSuffix):], "/")
+	name, ext, foundExt := strings.Cut(tile, ".")
+	col, row, foundRow := strings.Cut(name, "_")
+	format, ok := dziTileFormats[ext]
+	if !found || !foundExt || !foundRow || !ok {
+		return req, fmt.Errorf("invalid deep zoom tile requested: (path=%s)", path)
+	}
+	req.Format = format
+
+	var err error
+	for _, v := range []struct {
+		value string
+		dst   *int
+	}{{level, &req.Level}, {col, &req.Col}, {row, &req.Row}} {
+		*v.dst, err = strconv.Atoi(v.value)
+		if err != nil || *v.dst < 0 {
+			return req, fmt.Errorf("invalid deep zoom tile requested: (path=%s)", path)
+		}
+	}
+	return req, nil
+}
+
+// options converts the tile request into resize options for a source image of the given size.
+func (req dziRequest) options(width, height int) (Options, error) {
+	src, w, h, err := dziTile(width, height, req.Level, req.Col, req.Row)
+	if err != nil {
+		return Options{}, err
+	}
+
+	opts := Options{Operation: dziOperation, Width: w, Height: h, Force: true, NoTrim: true, Format: req.Format}
+	if src != image.Rect(0, 0, width, height) {
+		opts.Extract = Region{
+			Left: float64(src.Min.X), Top: float64(src.Min.Y),
+			Width: float64(src.Dx()), Height: float64(src.Dy()),
+		}
+	}
+	return opts, nil
+}
+
+// dziMaxLevel returns the level of the pyramid at which the image has its full size,
+// every level below is half the size of the one above and level 0 is a single pixel.
+func dziMaxLevel(width, height int) int {
+	return int(math.Ceil(math.Log2(float64(max(width, height)))))
+}
+
+// dziLevelSize returns the size of the image at the level of its pyramid.
+func dziLevelSize(width, height, level int) (int, int) {
+	scale := math.Pow(2, float64(level-dziMaxLevel(width, height)))
+	return int(math.Ceil(float64(width) * scale)), int(math.Ceil(float64(height) * scale))
+}
+
+// dziBaseLevel returns the highest level of the pyramid fitting into dziBaseSize.
+func dziBaseLevel(width, height int) int {
+	level := dziMaxLevel(width, height)
+	for ; level > 0; level-- {
+		if w, h := dziLevelSize(width, height, level); max(w, h) <= dziBaseSize {
+			break
+		}
+	}
+	return level
+}
+
+// dziTile returns the area of the source image the tile is made of and the size of the tile.
+// Tiles overlap their neighbours by dziOverlap pixels.
+func dziTile(width, height, level, col, row int) (image.Rectangle, int, int, error) {
+	maxLevel := dziMaxLevel(width, height)
+	if level > maxLevel {
+		return image.Rectangle{}, 0, 0, fmt.Errorf("deep zoom level %d is out of range, the image has %d levels",
+			level, maxLevel+1)
+	}
+
+	scale := math.Pow(2, float64(level-maxLevel))
+	levelWidth, levelHeight := dziLevelSize(width, height, level)
+
+	// checked before multiplying as the values come from the URL
+	if col >= (levelWidth+dziTileSize-1)/dziTileSize || row >= (levelHeight+dziTileSize-1)/dziTileSize {
+		return image.Rectangle{}, 0, 0, fmt.Errorf("deep zoom tile %d_%d is out of range at level %d", col, row, level)
+	}
+	tile := image.Rect(col*dziTileSize, row*dziTileSize, (col+1)*dziTileSize, (row+1)*dziTileSize)
+	tile = tile.Inset(-dziOverlap).Intersect(image.Rect(0, 0, levelWidth, levelHeight))
+
+	src := image.Rect(
+		int(math.Floor(float64(tile.Min.X)/scale)), int(math.Floor(float64(tile.Min.Y)/scale)),
+		int(math.Ceil(float64(tile.Max.X)/scale)), int(math.Ceil(float64(tile.Max.Y)/scale)),
+	).Intersect(image.Rect(0, 0, width, height))
+	return src, tile.Dx(), tile.Dy(), nil
+}
@@ -0,0 +1,136 @@
+package internalhttp
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDZIPath(t *testing.T) {
+	t.Parallel()
+	req, err := parseDZIPath("/dzi/example.com/images/a.jpg.dzi")
+	require.NoError(t, err)
+	require.Equal(t, dziRequest{URL: "example.com/images/a.jpg", Descriptor: true}, req)
+
+	req, err = parseDZIPath("/dzi/example.com/images/a.jpg_files/12/3_4.png")
+	require.NoError(t, err)
+	require.Equal(t, dziRequest{URL: "example.com/images/a.jpg", Level: 12, Col: 3, Row: 4, Format: PNG}, req)
+
+	for _, path := range []string{
+		"/dzi/.dzi", "/dzi/a.jpg", "/dzi/_files/1/0_0.jpg", "/dzi/a.jpg_files/1/0_0",
+		"/dzi/a.jpg_files/1/0.jpg", "/dzi/a.jpg_files/1/0_0.tif", "/dzi/a.jpg_files/x/0_0.jpg",
+		"/dzi/a.jpg_files/1/-1_0.jpg",
+	} {
+		_, err = parseDZIPath(path)
+		require.Error(t, err, path)
+	}
+}
+
+func TestDZITile(t *testing.T) {
+	t.Parallel()
+	// 1000x600 image has levels 0 to 10
+	require.Equal(t, 10, dziMaxLevel(1000, 600))
+
+	tests := []struct {
+		level, col, row int
+		src             image.Rectangle
+		w, h            int
+		invalid         bool
+	}{
+		{level: 10, col: 0, row: 0, src: image.Rect(0, 0, 255, 255), w: 255, h: 255},
+		{level: 10, col: 1, row: 1, src: image.Rect(253, 253, 509, 509), w: 256, h: 256},
+		{level: 10, col: 3, row: 2, src: image.Rect(761, 507, 1000, 600), w: 239, h: 93},
+		{level: 9, col: 1, row: 0, src: image.Rect(506, 0, 1000, 510), w: 247, h: 255},
+		{level: 0, col: 0, row: 0, src: image.Rect(0, 0, 1000, 600), w: 1, h: 1},
+		{level: 10, col: 4, row: 0, invalid: true},
+		{level: 10, col: math.MaxInt / 100, row: 0, invalid: true},
+		{level: 10, col: 0, row: math.MaxInt/dziTileSize + 1, invalid: true},
+		{level: 11, col: 0, row: 0, invalid: true},
+	}
+
+	for _, tc := range tests {
+		src, w, h, err := dziTile(1000, 600, tc.level, tc.col, tc.row)
+		if tc.invalid {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.src, src, "level %d tile %d_%d", tc.level, tc.col, tc.row)
+		require.Equal(t, []int{tc.w, tc.h}, []int{w, h}, "level %d tile %d_%d", tc.level, tc.col, tc.row)
+	}
+}
+
+func TestDZIBaseLevel(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, 10, dziBaseLevel(2000, 1000))
+	require.Equal(t, 10, dziBaseLevel(1000, 600), "small images have no lower base")
+	require.Equal(t, 0, dziBaseLevel(1, 1))
+
+	// the levels of the base match those of the source
+	w, h := dziLevelSize(3001, 1999, dziBaseLevel(3001, 1999))
+	require.Equal(t, []int{751, 500}, []int{w, h})
+	for level := 0; level <= dziBaseLevel(3001, 1999); level++ {
+		_, sw, sh, err := dziTile(3001, 1999, level, 0, 0)
+		require.NoError(t, err)
+		_, bw, bh, err := dziTile(w, h, level, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int{sw, sh}, []int{bw, bh}, "level %d", level)
+	}
+}
+
+func TestDZIRouteLowLevels(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("id") {
+		case "5":
+			buf, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 2000, 1000)))
+			w.Write(buf)
+		case "6":
+			buf, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 4000, 500)))
+			w.Write(buf)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	mux := o.NewServerMux()
+	tile := func(path, id string) image.Config {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dzi/"+ts.URL+"/img_files/"+path+".png?id="+id, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Header().Get("Error"))
+		config, err := png.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+		require.NoError(t, err)
+		return config
+	}
+
+	config := tile("9/1_0", "5")
+	require.Equal(t, []int{247, 250}, []int{config.Width, config.Height})
+	config = tile("0/0_0", "5")
+	require.Equal(t, []int{1, 1}, []int{config.Width, config.Height})
+
+	// the tiles of the low levels are cut out of a single downscaled source
+	base := Options{Operation: dziOperation, Width: 1000, Height: 500, Force: true, NoTrim: true, Format: PNG}
+	ci, found := o.ConvertedImageCache.Get(base.cacheKey() + "-" + ts.URL + "/img?id=5")
+	require.True(t, found)
+	config, err := png.DecodeConfig(bytes.NewReader(ci.Content))
+	require.NoError(t, err)
+	require.Equal(t, []int{1000, 500}, []int{config.Width, config.Height})
+
+	config = tile("11/7_3", "5")
+	require.Equal(t, []int{223, 239}, []int{config.Width, config.Height})
+
+	// the levels between the base and the full size are downscaled once each
+	config = tile("11/1_0", "6")
+	require.Equal(t, []int{256, 250}, []int{config.Width, config.Height})
+	level := Options{Operation: dziOperation, Width: 2000, Height: 250, Force: true, NoTrim: true, Format: PNG}
+	_, found = o.ConvertedImageCache.Get(level.cacheKey() + "-" + ts.URL + "/img?id=6")
+	require.True(t, found)
+}
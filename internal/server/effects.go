@@ -0,0 +1,212 @@
+package internalhttp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strings"
+)
+
+const (
+	MaskCircle  = "circle"
+	MaskRounded = "rounded"
+
+	// part of the shorter side used as corner radius if none was requested.
+	defaultRadiusRatio = 0.1
+	// largest radius, border and padding in pixels.
+	maxEffectSize = 1000
+)
+
+var (
+	colorWhite = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	colorBlack = color.NRGBA{A: 255}
+)
+
+// hasEffects reports whether the resized image has to be post processed.
+func (opts Options) hasEffects() bool {
+	return opts.Mask != "" || opts.Border > 0 || opts.Padding > 0 || opts.Text.isSet() || opts.Palette > 0
+}
+
+// needsAlpha reports whether the post processed image has transparent parts.
+func (opts Options) needsAlpha() bool {
+	return opts.Mask != "" || (opts.Padding > 0 && opts.Background.A < 255)
+}
+
+// effectsFormat returns the output format for the post processed image,
+// switching to PNG if the image needs transparency the format can't hold.
+func effectsFormat(opts Options, source ImageType) ImageType {
+	format := opts.Format
+	if format == UNKNOWN {
+		format = source
+	}
+	if opts.Palette > 0 {
+		return paletteFormat(format)
+	}
+	if format != PNG && format != WEBP && format != GIF && opts.needsAlpha() {
+		return PNG
+	}
+	return format
+}
+
+// applyEffects decodes the resized PNG image and applies the text, the mask, the padding and the border to it.
+func applyEffects(buf []byte, opts Options) (*image.NRGBA, error) {
+	src, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode resized image: %w", err)
+	}
+	return composeEffects(src, opts)
+}
+
+// composeEffects renders the text onto the image, surrounds it with padding and border
+// and cuts the result to the mask shape. The border follows the shape of the mask.
+func composeEffects(src image.Image, opts Options) (*image.NRGBA, error) {
+	b := src.Bounds()
+	inset := opts.Padding + opts.Border
+	canvas := image.NewNRGBA(image.Rect(0, 0, b.Dx()+2*inset, b.Dy()+2*inset))
+	content := b.Sub(b.Min).Add(image.Pt(inset, inset))
+
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(opts.Background), image.Point{}, draw.Src)
+	draw.Draw(canvas, content, src, b.Min, draw.Over)
+
+	if opts.Text.isSet() {
+		dst, _ := canvas.SubImage(content).(draw.Image)
+		err := drawText(dst, opts.Text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	outer := newShape(opts.Mask, opts.Radius, canvas.Bounds())
+	inner := outer.inset(opts.Border)
+
+	for y := 0; y < canvas.Bounds().Dy(); y++ {
+		for x := 0; x < canvas.Bounds().Dx(); x++ {
+			// sample in the middle of the pixel
+			px, py := float64(x)+0.5, float64(y)+0.5
+			c := canvas.NRGBAAt(x, y)
+			if opts.Border > 0 {
+				c = mixColors(c, opts.BorderColor, 1-inner.coverage(px, py))
+			}
+			c.A = uint8(math.Round(float64(c.A) * outer.coverage(px, py)))
+			canvas.SetNRGBA(x, y, c)
+		}
+	}
+	return canvas, nil
+}
+
+// encodeImage encodes the post processed image into the output format, quantizing it if requested.
+func encodeImage(img *image.NRGBA, format ImageType, opts Options) ([]byte, error) {
+	if opts.Palette > 0 {
+		return encodePaletted(quantize(img, opts.Palette, opts.Dither), paletteFormat(format))
+	}
+
+	var encoded image.Image = img
+	if format == JPEG {
+		encoded = flattenImage(img)
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode image: %w", err)
+	}
+	if format == PNG {
+		return buf.Bytes(), nil
+	}
+	return processingEngine().Resize(buf.Bytes(), EngineOptions{Type: format, Quality: opts.Quality})
+}
+
+// mixColors blends the color c2 over c1 in proportion t taking alpha into account.
+func mixColors(c1, c2 color.NRGBA, t float64) color.NRGBA {
+	if t <= 0 {
+		return c1
+	}
+	if t >= 1 {
+		return c2
+	}
+	a1, a2 := float64(c1.A)*(1-t), float64(c2.A)*t
+	a := a1 + a2
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	mix := func(v1, v2 uint8) uint8 {
+		return uint8(math.Round((float64(v1)*a1 + float64(v2)*a2) / a))
+	}
+	return color.NRGBA{R: mix(c1.R, c2.R), G: mix(c1.G, c2.G), B: mix(c1.B, c2.B), A: uint8(math.Round(a))}
+}
+
+// shape is a rounded rectangle or a circle inscribed into a rectangle.
+type shape struct {
+	minX, minY, maxX, maxY float64
+	radius                 float64
+	circle                 bool
+}
+
+func newShape(mask string, radius int, r image.Rectangle) shape {
+	s := shape{
+		minX: float64(r.Min.X), minY: float64(r.Min.Y),
+		maxX: float64(r.Max.X), maxY: float64(r.Max.Y),
+		radius: float64(radius),
+		circle: mask == MaskCircle,
+	}
+	switch {
+	case mask == MaskRounded && radius <= 0:
+		s.radius = math.Min(s.maxX-s.minX, s.maxY-s.minY) * defaultRadiusRatio
+	case mask != MaskRounded:
+		s.radius = 0
+	}
+	return s
+}
+
+// inset returns the shape shrunk by n pixels on every side.
+func (s shape) inset(n int) shape {
+	d := float64(n)
+	s.minX, s.minY, s.maxX, s.maxY = s.minX+d, s.minY+d, s.maxX-d, s.maxY-d
+	s.radius = math.Max(s.radius-d, 0)
+	return s
+}
+
+// coverage returns how much of the pixel centered at x, y is inside the shape, from 0 to 1.
+func (s shape) coverage(x, y float64) float64 {
+	hw, hh := (s.maxX-s.minX)/2, (s.maxY-s.minY)/2
+	if hw <= 0 || hh <= 0 {
+		return 0
+	}
+	dx, dy := math.Abs(x-(s.minX+hw)), math.Abs(y-(s.minY+hh))
+
+	// signed distance from the edge of the shape, negative inside
+	var d float64
+	if s.circle {
+		d = math.Hypot(dx, dy) - math.Min(hw, hh)
+	} else {
+		r := math.Min(s.radius, math.Min(hw, hh))
+		qx, qy := dx-(hw-r), dy-(hh-r)
+		d = math.Hypot(math.Max(qx, 0), math.Max(qy, 0)) + math.Min(math.Max(qx, qy), 0) - r
+	}
+	return math.Max(0, math.Min(1, 0.5-d))
+}
+
+// parseColor parses colors written as RRGGBB or RRGGBBAA hex values or the word transparent.
+func parseColor(value string) (color.NRGBA, error) {
+	if strings.EqualFold(value, "transparent") {
+		return color.NRGBA{}, nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+	if err != nil || (len(b) != 3 && len(b) != 4) {
+		return color.NRGBA{}, fmt.Errorf("invalid color provided: (color=%s)", value)
+	}
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 255}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
+
+func formatColor(c color.NRGBA) string {
+	return hex.EncodeToString([]byte{c.R, c.G, c.B, c.A})
+}
@@ -0,0 +1,80 @@
+package internalhttp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeEffects(t *testing.T) {
+	t.Parallel()
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(src, src.Bounds(), image.NewUniform(red), image.Point{}, draw.Src)
+
+	t.Run("circle", func(t *testing.T) {
+		t.Parallel()
+		out, err := composeEffects(src, Options{Mask: MaskCircle})
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 20, 20), out.Bounds())
+		require.Equal(t, uint8(0), out.NRGBAAt(0, 0).A, "corner should be cut out")
+		require.Equal(t, red, out.NRGBAAt(10, 10))
+		require.Equal(t, red, out.NRGBAAt(10, 1), "edge middle should stay")
+	})
+
+	t.Run("rounded", func(t *testing.T) {
+		t.Parallel()
+		out, err := composeEffects(src, Options{Mask: MaskRounded, Radius: 5})
+		require.NoError(t, err)
+		require.Equal(t, uint8(0), out.NRGBAAt(0, 0).A)
+		require.Equal(t, red, out.NRGBAAt(5, 0))
+		require.Equal(t, red, out.NRGBAAt(19, 10))
+	})
+
+	t.Run("padding and border", func(t *testing.T) {
+		t.Parallel()
+		out, err := composeEffects(src, Options{Border: 2, BorderColor: blue, Padding: 3, Background: colorWhite})
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 30, 30), out.Bounds())
+		require.Equal(t, blue, out.NRGBAAt(0, 0))
+		require.Equal(t, blue, out.NRGBAAt(29, 1))
+		require.Equal(t, colorWhite, out.NRGBAAt(2, 2))
+		require.Equal(t, red, out.NRGBAAt(5, 5))
+	})
+
+	t.Run("border follows circle", func(t *testing.T) {
+		t.Parallel()
+		out, err := composeEffects(src, Options{Mask: MaskCircle, Border: 2, BorderColor: blue})
+		require.NoError(t, err)
+		require.Equal(t, uint8(0), out.NRGBAAt(0, 0).A)
+		require.Equal(t, blue, out.NRGBAAt(10, 1))
+		require.Equal(t, red, out.NRGBAAt(10, 3))
+	})
+}
+
+func TestEffectsFormat(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, PNG, effectsFormat(Options{Mask: MaskCircle}, JPEG))
+	require.Equal(t, WEBP, effectsFormat(Options{Mask: MaskCircle, Format: WEBP}, JPEG))
+	require.Equal(t, JPEG, effectsFormat(Options{Border: 1}, JPEG))
+	require.Equal(t, PNG, effectsFormat(Options{Padding: 1}, JPEG))
+	require.Equal(t, JPEG, effectsFormat(Options{Padding: 1, Background: colorWhite}, JPEG))
+}
+
+func TestParseColor(t *testing.T) {
+	t.Parallel()
+	c, err := parseColor("#ff8000")
+	require.NoError(t, err)
+	require.Equal(t, color.NRGBA{255, 128, 0, 255}, c)
+
+	c, err = parseColor("transparent")
+	require.NoError(t, err)
+	require.Equal(t, color.NRGBA{}, c)
+
+	_, err = parseColor("red")
+	require.Error(t, err)
+}
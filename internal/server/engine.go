@@ -0,0 +1,189 @@
+package internalhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync/atomic"
+)
+
+// ImageType is the format of an encoded image.
+type ImageType int
+
+const (
+	UNKNOWN ImageType = iota
+	JPEG
+	WEBP
+	PNG
+	TIFF
+	GIF
+	PDF
+	SVG
+	HEIF
+	AVIF
+)
+
+// ImageTypes holds the names of the image types.
+var ImageTypes = map[ImageType]string{
+	UNKNOWN: "unknown",
+	JPEG:    "jpeg",
+	WEBP:    "webp",
+	PNG:     "png",
+	TIFF:    "tiff",
+	GIF:     "gif",
+	PDF:     "pdf",
+	SVG:     "svg",
+	HEIF:    "heif",
+	AVIF:    "avif",
+}
+
+// Gravity is the part of the image kept when it is cropped.
+type Gravity int
+
+const (
+	GravityCentre Gravity = iota
+	GravityNorth
+	GravityEast
+	GravitySouth
+	GravityWest
+	GravitySmart
+)
+
+// ImageSize holds the dimensions of an image.
+type ImageSize struct {
+	Width, Height int
+}
+
+// EngineOptions are the parameters of one processing pass of an engine.
+type EngineOptions struct {
+	Width, Height int
+	Extract       image.Rectangle // area of the source cut out before rotating and resizing, all of it if empty
+	Enlarge       bool            // allow results larger than the source
+	Trim          bool            // trim uniform borders from the result
+	Force         bool            // resize to exactly Width x Height ignoring the aspect ratio
+	Crop          bool            // cover Width x Height and crop what is outside according to Gravity
+	Gravity       Gravity
+	Rotate        int  // clockwise rotation in degrees, a multiple of 90
+	Flip          bool // mirror horizontally after rotating
+	Flop          bool // mirror vertically after rotating
+	Grayscale     bool
+	Type          ImageType // output format, UNKNOWN keeps the source format
+	Quality       int       // output quality, 0 uses the engine default
+}
+
+// Engine decodes, transforms and encodes images. Resize keeps the aspect ratio if only one of
+// the dimensions is set and returns the source size if none is.
+type Engine interface {
+	Resize(buf []byte, opts EngineOptions) ([]byte, error)
+	Size(buf []byte) (ImageSize, error)
+	// Rasterize renders an SVG image or a PDF document page as PNG at the size opts asks for.
+	Rasterize(buf []byte, imageType ImageType, opts Options) ([]byte, error)
+	Version() string
+}
+
+type namedEngine struct {
+	name string
+	Engine
+}
+
+var (
+	engines       = map[string]Engine{}
+	currentEngine atomic.Pointer[namedEngine]
+
+	ErrUnknownEngine       = errors.New("unknown processing engine")
+	ErrUnsupportedByEngine = errors.New("operation is not supported by the processing engine")
+)
+
+// registerEngine makes the engine available by name, the preferred engine becomes
+// the default one, otherwise the first registered engine is.
+func registerEngine(name string, e Engine, preferred bool) {
+	engines[name] = e
+	if preferred || currentEngine.Load() == nil {
+		currentEngine.Store(&namedEngine{name: name, Engine: e})
+	}
+}
+
+// SetEngine selects the processing engine by name, it is meant to be called once on startup.
+func SetEngine(name string) error {
+	e, ok := engines[name]
+	if !ok {
+		return fmt.Errorf("%w: (engine=%s) (available=%v)", ErrUnknownEngine, name, EngineNames())
+	}
+	currentEngine.Store(&namedEngine{name: name, Engine: e})
+	return nil
+}
+
+// EngineName returns the name of the selected processing engine.
+func EngineName() string {
+	return currentEngine.Load().name
+}
+
+// EngineNames returns the names of the engines available in this build.
+func EngineNames() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EngineVersion describes the selected processing engine and its libraries.
+func EngineVersion() string {
+	return currentEngine.Load().Version()
+}
+
+func processingEngine() Engine {
+	return currentEngine.Load().Engine
+}
+
+// GetImageSize returns the dimensions of the encoded image.
+func GetImageSize(buf []byte) (ImageSize, error) {
+	return processingEngine().Size(buf)
+}
+
+var (
+	svgTag      = []byte("<svg")
+	svgMaxBytes = 1024
+)
+
+// DetermineImageType recognizes the format of the encoded image by its signature.
+func DetermineImageType(buf []byte) ImageType {
+	switch {
+	case len(buf) < 12:
+		return UNKNOWN
+	case bytes.HasPrefix(buf, []byte{0xff, 0xd8, 0xff}):
+		return JPEG
+	case bytes.HasPrefix(buf, []byte("\x89PNG")):
+		return PNG
+	case bytes.HasPrefix(buf, gifSignature):
+		return GIF
+	case bytes.HasPrefix(buf, []byte("RIFF")) && bytes.Equal(buf[8:12], []byte("WEBP")):
+		return WEBP
+	case bytes.HasPrefix(buf, []byte("II*\x00")) || bytes.HasPrefix(buf, []byte("MM\x00*")):
+		return TIFF
+	case bytes.HasPrefix(buf, []byte("%PDF")):
+		return PDF
+	case bytes.Equal(buf[4:8], []byte("ftyp")):
+		return isobmffType(buf[8:12])
+	}
+
+	head := bytes.TrimSpace(buf[:min(len(buf), svgMaxBytes)])
+	if bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, svgTag) {
+		return SVG
+	}
+	return UNKNOWN
+}
+
+// isobmffType tells HEIF and AVIF images apart by the brand of the ftyp box.
+func isobmffType(brand []byte) ImageType {
+	switch string(brand) {
+	case "avif", "avis":
+		return AVIF
+	case "heic", "heix", "hevc", "hevx", "mif1", "msf1":
+		return HEIF
+	}
+	return UNKNOWN
+}
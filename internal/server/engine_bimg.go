@@ -0,0 +1,97 @@
+//go:build cgo && !purego
+
+package internalhttp
+
+import "github.com/h2non/bimg"
+
+const (
+	bimgEngineName = "bimg"
+
+	// zlib level of the PNG holding an extracted area, it is decoded right away so speed matters more than size.
+	bimgAreaCompression = 1
+)
+
+var (
+	bimgTypes = map[ImageType]bimg.ImageType{
+		UNKNOWN: bimg.UNKNOWN,
+		JPEG:    bimg.JPEG,
+		WEBP:    bimg.WEBP,
+		PNG:     bimg.PNG,
+		TIFF:    bimg.TIFF,
+		GIF:     bimg.GIF,
+		PDF:     bimg.PDF,
+		SVG:     bimg.SVG,
+		HEIF:    bimg.HEIF,
+		AVIF:    bimg.AVIF,
+	}
+
+	bimgGravities = map[Gravity]bimg.Gravity{
+		GravityCentre: bimg.GravityCentre,
+		GravityNorth:  bimg.GravityNorth,
+		GravityEast:   bimg.GravityEast,
+		GravitySouth:  bimg.GravitySouth,
+		GravityWest:   bimg.GravityWest,
+		GravitySmart:  bimg.GravitySmart,
+	}
+)
+
+func init() {
+	// libvips is preferred whenever the build has it
+	registerEngine(bimgEngineName, bimgEngine{}, true)
+}
+
+// bimgEngine processes images with libvips through bimg.
+type bimgEngine struct{}
+
+func (bimgEngine) Resize(buf []byte, opts EngineOptions) ([]byte, error) {
+	outputType := bimgTypes[opts.Type]
+	if !opts.Extract.Empty() {
+		if outputType == bimg.UNKNOWN {
+			// the format of the source is kept rather than the one of the extracted area
+			outputType = bimg.DetermineImageType(buf)
+		}
+		// libvips cuts areas out of the resized image, so the area is cut out losslessly first
+		// and only it is resized
+		area := opts.Extract
+		var err error
+		buf, err = bimg.Resize(buf, bimg.Options{
+			Top: area.Min.Y, Left: area.Min.X, AreaWidth: area.Dx(), AreaHeight: area.Dy(),
+			Type: bimg.PNG, Compression: bimgAreaCompression,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := bimg.Options{
+		Enlarge: opts.Enlarge,
+		Trim:    opts.Trim,
+		Width:   opts.Width,
+		Height:  opts.Height,
+		Force:   opts.Force,
+		Crop:    opts.Crop,
+		Gravity: bimgGravities[opts.Gravity],
+		Rotate:  bimg.Angle(opts.Rotate),
+		Flip:    opts.Flip,
+		Flop:    opts.Flop,
+		Type:    outputType,
+		Quality: opts.Quality,
+	}
+	if opts.Grayscale {
+		params.Interpretation = bimg.InterpretationBW
+	}
+	return bimg.Resize(buf, params)
+}
+
+func (bimgEngine) Size(buf []byte) (ImageSize, error) {
+	size, err := bimg.Size(buf)
+	return ImageSize{Width: size.Width, Height: size.Height}, err
+}
+
+func (bimgEngine) Rasterize(buf []byte, imageType ImageType, opts Options) ([]byte, error) {
+	return rasterizeVector(buf, imageType, opts)
+}
+
+func (bimgEngine) Version() string {
+	return "bimg version: " + bimg.Version + ", vips version: " + bimg.VipsVersion
+}
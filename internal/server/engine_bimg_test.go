@@ -0,0 +1,51 @@
+//go:build cgo && !purego
+
+package internalhttp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBimgEngineResizeExtract(t *testing.T) {
+	t.Parallel()
+	// a wide strip, red up to x=3990 and blue after it
+	img := image.NewNRGBA(image.Rect(0, 0, 4000, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 4000; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= 3990 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	src, err := encodeGo(img, JPEG, 95, false)
+	require.NoError(t, err)
+
+	e := bimgEngine{}
+	// only the area is scaled, not the whole source by the scale of the area
+	buf, err := e.Resize(src, EngineOptions{Extract: image.Rect(3990, 0, 4000, 10), Width: 2000, Enlarge: true})
+	require.NoError(t, err)
+	require.Equal(t, JPEG, DetermineImageType(buf), "the source format should be kept")
+	size, err := e.Size(buf)
+	require.NoError(t, err)
+	require.Equal(t, ImageSize{Width: 2000, Height: 2000}, size)
+
+	buf, err = e.Resize(src, EngineOptions{Extract: image.Rect(3980, 0, 4000, 10), Height: 5, Rotate: 180, Type: PNG})
+	require.NoError(t, err)
+	out, _, err := decodeGo(buf)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 10, 5), out.Bounds())
+	// rotating moved the blue half of the area to the left
+	c := out.NRGBAAt(1, 2)
+	require.True(t, c.B > 200 && c.R < 50, c)
+	c = out.NRGBAAt(8, 2)
+	require.True(t, c.R > 200 && c.B < 50, c)
+
+	_, err = e.Resize(src, EngineOptions{Extract: image.Rect(3990, 0, 4010, 10)})
+	require.Error(t, err)
+}
@@ -0,0 +1,345 @@
+package internalhttp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp" // register the decoder
+)
+
+const (
+	goEngineName = "go"
+
+	// same default quality libvips encodes with through bimg.
+	goDefaultQuality = 75
+	// difference of a channel from the background up to which a border pixel is trimmed.
+	goTrimThreshold = 10
+)
+
+var goEncoders = map[ImageType]func(w io.Writer, img image.Image, quality int) error{
+	JPEG: func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, flattenImage(img), &jpeg.Options{Quality: quality})
+	},
+	PNG: func(w io.Writer, img image.Image, _ int) error {
+		return png.Encode(w, img)
+	},
+	GIF: func(w io.Writer, img image.Image, _ int) error {
+		return gif.Encode(w, img, nil)
+	},
+	TIFF: func(w io.Writer, img image.Image, _ int) error {
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	},
+}
+
+func init() {
+	registerEngine(goEngineName, goEngine{}, false)
+}
+
+// goEngine processes images with the standard library and golang.org/x/image, it needs no cgo
+// but is slower than libvips, cannot render vector images, does not encode WEBP and ignores
+// the EXIF orientation.
+type goEngine struct{}
+
+func (goEngine) Resize(buf []byte, opts EngineOptions) ([]byte, error) {
+	src, sourceType, err := decodeGo(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Extract.Empty() {
+		if !opts.Extract.In(src.Bounds()) {
+			return nil, fmt.Errorf("extract area is outside of the image: (area=%v) (size=%v)", opts.Extract, src.Bounds())
+		}
+		src = copyNRGBA(src.SubImage(opts.Extract))
+	}
+
+	img := rotateImage(src, opts.Rotate)
+	if opts.Flip {
+		img = mirrorImage(img, true)
+	}
+	if opts.Flop {
+		img = mirrorImage(img, false)
+	}
+
+	b := img.Bounds()
+	w, h, cropW, cropH := goResizeSize(b.Dx(), b.Dy(), opts)
+	if w != b.Dx() || h != b.Dy() {
+		scaled := image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+		img = scaled
+	}
+
+	if cropW < w || cropH < h {
+		img = cropImage(img, cropW, cropH, opts.Gravity)
+	} else if opts.Trim {
+		img = trimImage(img)
+	}
+
+	if opts.Grayscale {
+		img = grayscaleImage(img)
+	}
+
+	format := opts.Type
+	if format == UNKNOWN {
+		format = sourceType
+	}
+	return encodeGo(img, format, opts.Quality, opts.Type == UNKNOWN)
+}
+
+func (goEngine) Size(buf []byte) (ImageSize, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return ImageSize{}, fmt.Errorf("unable to decode image: %w", err)
+	}
+	return ImageSize{Width: cfg.Width, Height: cfg.Height}, nil
+}
+
+func (goEngine) Rasterize([]byte, ImageType, Options) ([]byte, error) {
+	return nil, fmt.Errorf("%w: (operation=rasterize) (engine=%s)", ErrUnsupportedByEngine, goEngineName)
+}
+
+func (goEngine) Version() string {
+	return "go engine"
+}
+
+// decodeGo decodes the image into an NRGBA copy, the type is the one of the source.
+func decodeGo(buf []byte) (*image.NRGBA, ImageType, error) {
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, UNKNOWN, fmt.Errorf("unable to decode image: %w", err)
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out, DetermineImageType(buf), nil
+}
+
+// encodeGo writes the image in the given format, with fallback set formats the engine cannot
+// encode are written as PNG instead of failing.
+func encodeGo(img image.Image, format ImageType, quality int, fallback bool) ([]byte, error) {
+	encode, ok := goEncoders[format]
+	if !ok && fallback {
+		encode, ok = goEncoders[PNG]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: (encode=%s) (engine=%s)", ErrUnsupportedByEngine, ImageTypes[format], goEngineName)
+	}
+	if quality <= 0 {
+		quality = goDefaultQuality
+	}
+
+	var buf bytes.Buffer
+	err := encode(&buf, img, quality)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// goResizeSize returns the size the source is scaled to and the size it is then cropped to,
+// following the rules libvips applies through bimg.
+func goResizeSize(inWidth, inHeight int, opts EngineOptions) (int, int, int, int) {
+	width, height := opts.Width, opts.Height
+	if width <= 0 && height <= 0 {
+		return inWidth, inHeight, inWidth, inHeight
+	}
+
+	if opts.Force {
+		if width <= 0 {
+			width = inWidth
+		}
+		if height <= 0 {
+			height = inHeight
+		}
+		return width, height, width, height
+	}
+
+	xScale, yScale := float64(width)/float64(inWidth), float64(height)/float64(inHeight)
+	var scale float64
+	switch {
+	case width <= 0:
+		scale = yScale
+	case height <= 0:
+		scale = xScale
+	case opts.Crop:
+		scale = math.Max(xScale, yScale)
+	default:
+		scale = math.Min(xScale, yScale)
+	}
+	if !opts.Enlarge && scale > 1 {
+		scale = 1
+	}
+
+	w := max(1, int(math.Round(float64(inWidth)*scale)))
+	h := max(1, int(math.Round(float64(inHeight)*scale)))
+	if !opts.Crop || width <= 0 || height <= 0 {
+		return w, h, w, h
+	}
+	return w, h, min(w, width), min(h, height)
+}
+
+// cropImage cuts the area of the given size out of the image at the side the gravity points to.
+func cropImage(img *image.NRGBA, width, height int, gravity Gravity) *image.NRGBA {
+	b := img.Bounds()
+	left, top := (b.Dx()-width)/2, (b.Dy()-height)/2
+	switch gravity {
+	case GravityNorth:
+		top = 0
+	case GravityEast:
+		left = b.Dx() - width
+	case GravitySouth:
+		top = b.Dy() - height
+	case GravityWest:
+		left = 0
+	case GravitySmart:
+		left, top = smartCropOffset(img, width, height)
+	case GravityCentre:
+	}
+	return copyNRGBA(img.SubImage(image.Rect(left, top, left+width, top+height).Add(b.Min)))
+}
+
+// smartCropOffset slides the window along the side that is too long and returns the position
+// holding the most detail, measured as the energy the seam carving uses.
+func smartCropOffset(img *image.NRGBA, width, height int) (int, int) {
+	g := newCarveGrid(img)
+	energy := g.energy()
+
+	horizontal := g.w > width
+	n, window := g.h, height
+	if horizontal {
+		n, window = g.w, width
+	}
+	sums := make([]float64, n)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			if horizontal {
+				sums[x] += energy[y*g.w+x]
+			} else {
+				sums[y] += energy[y*g.w+x]
+			}
+		}
+	}
+
+	best, bestSum, sum := 0, 0.0, 0.0
+	for i := 0; i < n; i++ {
+		sum += sums[i]
+		if i >= window {
+			sum -= sums[i-window]
+		}
+		if i >= window-1 && sum > bestSum {
+			best, bestSum = i-window+1, sum
+		}
+	}
+	if horizontal {
+		return best, (g.h - height) / 2
+	}
+	return (g.w - width) / 2, best
+}
+
+// trimImage removes the borders having the color of the top left pixel.
+func trimImage(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	bg := img.NRGBAAt(b.Min.X, b.Min.Y)
+	area := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !similarColors(img.NRGBAAt(x, y), bg, goTrimThreshold) {
+				area = area.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if area.Empty() || area == b {
+		return img
+	}
+	return copyNRGBA(img.SubImage(area))
+}
+
+func similarColors(c1, c2 color.NRGBA, threshold int) bool {
+	diff := func(a, b uint8) int {
+		if a > b {
+			return int(a - b)
+		}
+		return int(b - a)
+	}
+	return diff(c1.R, c2.R) <= threshold && diff(c1.G, c2.G) <= threshold &&
+		diff(c1.B, c2.B) <= threshold && diff(c1.A, c2.A) <= threshold
+}
+
+// rotateImage turns the image clockwise by a multiple of 90 degrees.
+func rotateImage(img *image.NRGBA, angle int) *image.NRGBA {
+	angle = ((angle % 360) + 360) % 360
+	if angle == 0 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if angle != 180 {
+		w, h = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			switch angle {
+			case 90:
+				out.SetNRGBA(w-1-y, x, c)
+			case 180:
+				out.SetNRGBA(w-1-x, h-1-y, c)
+			default:
+				out.SetNRGBA(y, h-1-x, c)
+			}
+		}
+	}
+	return out
+}
+
+// mirrorImage mirrors the image horizontally, or vertically if horizontal is false.
+func mirrorImage(img *image.NRGBA, horizontal bool) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := x, b.Dy()-1-y
+			if horizontal {
+				dx, dy = b.Dx()-1-x, y
+			}
+			out.SetNRGBA(dx, dy, img.NRGBAAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// grayscaleImage replaces the colors by their luminance keeping the transparency.
+func grayscaleImage(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			l := uint8(math.Round(0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)))
+			out.SetNRGBA(x, y, color.NRGBA{R: l, G: l, B: l, A: c.A})
+		}
+	}
+	return out
+}
+
+// flattenImage puts the image onto a white background as formats without transparency need.
+func flattenImage(img image.Image) image.Image {
+	flattened := image.NewNRGBA(img.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(colorWhite), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flattened
+}
+
+func copyNRGBA(img image.Image) *image.NRGBA {
+	out := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
@@ -0,0 +1,89 @@
+package internalhttp
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoResizeSize(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		opts                        EngineOptions
+		w, h, cropWidth, cropHeight int
+	}{
+		{opts: EngineOptions{}, w: 400, h: 200, cropWidth: 400, cropHeight: 200},
+		{opts: EngineOptions{Width: 100}, w: 100, h: 50, cropWidth: 100, cropHeight: 50},
+		{opts: EngineOptions{Height: 100}, w: 200, h: 100, cropWidth: 200, cropHeight: 100},
+		{opts: EngineOptions{Width: 100, Height: 100}, w: 100, h: 50, cropWidth: 100, cropHeight: 50},
+		{opts: EngineOptions{Width: 100, Height: 100, Crop: true}, w: 200, h: 100, cropWidth: 100, cropHeight: 100},
+		{opts: EngineOptions{Width: 100, Height: 100, Force: true}, w: 100, h: 100, cropWidth: 100, cropHeight: 100},
+		{opts: EngineOptions{Width: 800}, w: 400, h: 200, cropWidth: 400, cropHeight: 200},
+		{opts: EngineOptions{Width: 800, Enlarge: true}, w: 800, h: 400, cropWidth: 800, cropHeight: 400},
+	}
+
+	for _, tc := range tests {
+		w, h, cropWidth, cropHeight := goResizeSize(400, 200, tc.opts)
+		require.Equal(t, []int{tc.w, tc.h, tc.cropWidth, tc.cropHeight}, []int{w, h, cropWidth, cropHeight},
+			fmt.Sprintf("%+v", tc.opts))
+	}
+}
+
+func TestGoEngineResize(t *testing.T) {
+	t.Parallel()
+	// left half red, right half blue
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= 20 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	src, err := encodePNG(img)
+	require.NoError(t, err)
+
+	e := goEngine{}
+	buf, err := e.Resize(src, EngineOptions{Width: 10, Height: 10, Crop: true, Gravity: GravityEast, Rotate: 180})
+	require.NoError(t, err)
+	require.Equal(t, PNG, DetermineImageType(buf))
+
+	out, _, err := decodeGo(buf)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 10, 10), out.Bounds())
+	// rotating moved the red half to the right side the gravity keeps
+	require.Equal(t, color.NRGBA{R: 255, A: 255}, out.NRGBAAt(5, 5))
+
+	buf, err = e.Resize(src, EngineOptions{Width: 20, Type: JPEG})
+	require.NoError(t, err)
+	size, err := e.Size(buf)
+	require.NoError(t, err)
+	require.Equal(t, JPEG, DetermineImageType(buf))
+	require.Equal(t, ImageSize{Width: 20, Height: 10}, size)
+
+	_, err = e.Resize(src, EngineOptions{Type: WEBP})
+	require.ErrorIs(t, err, ErrUnsupportedByEngine)
+
+	// the area is cut out before rotating and scaling
+	buf, err = e.Resize(src, EngineOptions{Extract: image.Rect(10, 0, 30, 5), Width: 10, Rotate: 90, Enlarge: true})
+	require.NoError(t, err)
+	out, _, err = decodeGo(buf)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 10, 40), out.Bounds())
+	require.Equal(t, color.NRGBA{R: 255, A: 255}, out.NRGBAAt(5, 5))
+	require.Equal(t, color.NRGBA{B: 255, A: 255}, out.NRGBAAt(5, 35))
+
+	_, err = e.Resize(src, EngineOptions{Extract: image.Rect(30, 0, 50, 5)})
+	require.Error(t, err)
+}
+
+func TestSetEngine(t *testing.T) {
+	t.Parallel()
+	require.Contains(t, EngineNames(), goEngineName)
+	require.ErrorIs(t, SetEngine("unknown"), ErrUnknownEngine)
+}
@@ -0,0 +1,195 @@
+package internalhttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Dmit1812/imgresizr/pkg/breaker"
+)
+
+const (
+	// HeaderErrorCode is the response header carrying the machine-readable code of a failure,
+	// the Error header carries the message.
+	HeaderErrorCode = "Error-Code"
+	// HeaderRequestID is the request header a client may identify the request with,
+	// every response carries the ID in it.
+	HeaderRequestID = "X-Request-ID"
+
+	// classes of failures which can have their own error image.
+	ErrorClassNotFound = "notfound"
+	ErrorClassBadImage = "badimage"
+	ErrorClassTimeout  = "timeout"
+
+	problemMediaType   = "application/problem+json"
+	maxRequestIDLength = 128
+	requestIDChars     = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:"
+)
+
+var (
+	ErrUpstream    = errors.New("error downloading image")
+	ErrNotImage    = errors.New("invalid image at URL")
+	ErrUndecodable = errors.New("image at URL cannot be decoded")
+)
+
+// problem is the RFC 7807 document errors are answered with when the client prefers JSON.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Code      string `json:"code"`
+	Source    string `json:"source,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// UpstreamStatusError is returned when the source server answers with a status other than 200.
+type UpstreamStatusError struct {
+	Status int
+	URL    string
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("%s: (status=%d) (url=%s)", ErrUpstream, e.Status, e.URL)
+}
+
+func (e *UpstreamStatusError) Is(target error) bool {
+	return target == ErrUpstream
+}
+
+// errorStatus returns the HTTP status and the error code the failure is answered with.
+// Failures of the conversion not caused by the request are server errors, the others bad requests.
+func errorStatus(err error) (int, string) {
+	var statusErr *UpstreamStatusError
+	switch {
+	case errors.Is(err, ErrServerBusy):
+		return http.StatusServiceUnavailable, "server_busy"
+	case errors.Is(err, ErrDimensionsTooLarge):
+		return http.StatusBadRequest, "dimensions_too_large"
+	case errors.Is(err, ErrSourceTooLarge):
+		return http.StatusRequestEntityTooLarge, "source_too_large"
+	case errors.Is(err, ErrSourceTooManyPixels):
+		return http.StatusRequestEntityTooLarge, "source_too_many_pixels"
+	case errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound:
+		return http.StatusNotFound, "source_not_found"
+	case errors.As(err, &statusErr):
+		return http.StatusBadGateway, "upstream_status"
+	case errors.Is(err, breaker.ErrOpen):
+		return http.StatusBadGateway, "upstream_unavailable"
+	case errors.Is(err, ErrUpstream) && isTimeout(err):
+		return http.StatusGatewayTimeout, "upstream_timeout"
+	case errors.Is(err, ErrUpstream):
+		return http.StatusBadGateway, "upstream_error"
+	case errors.Is(err, ErrNotImage):
+		return http.StatusBadGateway, "not_an_image"
+	case errors.Is(err, ErrUndecodable):
+		return http.StatusUnprocessableEntity, "undecodable_image"
+	case isTimeout(err):
+		return http.StatusServiceUnavailable, "processing_timeout"
+	case errors.Is(err, ErrOutOfRange) || errors.Is(err, ErrRegionOutOfBounds) || errors.Is(err, ErrCarveTooLarge) ||
+		errors.Is(err, ErrMaxBytesUnreachable) || errors.Is(err, ErrFontNotFound) ||
+		errors.Is(err, ErrUnsupportedByEngine):
+		return http.StatusBadRequest, "bad_request"
+	case errors.Is(err, ErrConversion):
+		return http.StatusInternalServerError, "conversion_failed"
+	}
+	return http.StatusBadRequest, "bad_request"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// errorClass groups the error codes that share an error image.
+func errorClass(code string) string {
+	switch code {
+	case "source_not_found":
+		return ErrorClassNotFound
+	case "not_an_image", "undecodable_image":
+		return ErrorClassBadImage
+	case "upstream_timeout", "processing_timeout":
+		return ErrorClassTimeout
+	}
+	return ""
+}
+
+// errorImage returns the error image configured for the class of the code or the default one.
+func (o *Server) errorImage(code string) []byte {
+	if image := o.ErrorImages[errorClass(code)]; len(image) > 0 {
+		return image
+	}
+	return o.ErrorImage
+}
+
+// wantsProblem tells whether the client prefers a JSON problem document to an image,
+// that is it accepts JSON with a higher quality than any image.
+func wantsProblem(r *http.Request) bool {
+	var jsonQ, imageQ float64
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(accepted, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+		switch {
+		case mediaType == problemMediaType || mediaType == "application/json":
+			jsonQ = max(jsonQ, q)
+		case strings.HasPrefix(mediaType, "image/"):
+			imageQ = max(imageQ, q)
+		}
+	}
+	return jsonQ > imageQ
+}
+
+// requestID returns the ID the client sent with the request or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(HeaderRequestID); id != "" && len(id) <= maxRequestIDLength &&
+		strings.Trim(id, requestIDChars) == "" {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// writeError answers with the status and a problem document if the client prefers JSON, otherwise
+// with the error image or with the message as text when the error image is disabled or not loaded.
+func (o *Server) writeError(w http.ResponseWriter, r *http.Request, p problem, image []byte) {
+	w.Header().Set("Error", p.Detail)
+	w.Header().Set(HeaderErrorCode, p.Code)
+	switch {
+	case wantsProblem(r):
+		p.Type, p.Title, p.RequestID = "about:blank", http.StatusText(p.Status), w.Header().Get(HeaderRequestID)
+		body, _ := json.Marshal(p)
+		w.Header().Set("Content-Type", problemMediaType)
+		w.WriteHeader(p.Status)
+		w.Write(body)
+	case o.NoErrorImage || len(image) == 0:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(p.Status)
+		w.Write([]byte(p.Detail))
+	default:
+		w.Header().Set("Content-Type", GetImageMimeType(DetermineImageType(image)))
+		w.WriteHeader(p.Status)
+		w.Write(image)
+	}
+}
+
+// failedSource answers with the status matching the failure of loading or converting the source,
+// the error image is not resized.
+func (o *Server) failedSource(w http.ResponseWriter, r *http.Request, source string, err error) {
+	status, code := errorStatus(err)
+	p := problem{Status: status, Code: code, Detail: err.Error(), Source: source}
+	o.writeError(w, r, p, o.errorImage(code))
+}
@@ -0,0 +1,170 @@
+package internalhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Dmit1812/imgresizr/pkg/breaker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{err: &UpstreamStatusError{Status: 404}, status: http.StatusNotFound, code: "source_not_found"},
+		{err: &UpstreamStatusError{Status: 500}, status: http.StatusBadGateway, code: "upstream_status"},
+		{err: fmt.Errorf("%w: %w", ErrUpstream, errors.New("dial")), status: http.StatusBadGateway, code: "upstream_error"},
+		{
+			err:    fmt.Errorf("%w: %w", ErrUpstream, breaker.ErrOpen),
+			status: http.StatusBadGateway, code: "upstream_unavailable",
+		},
+		{
+			err:    fmt.Errorf("%w: %w", ErrUpstream, context.DeadlineExceeded),
+			status: http.StatusGatewayTimeout, code: "upstream_timeout",
+		},
+		{err: fmt.Errorf("%w: (url=x)", ErrNotImage), status: http.StatusBadGateway, code: "not_an_image"},
+		{err: fmt.Errorf("%w: (url=x)", ErrUndecodable), status: http.StatusUnprocessableEntity, code: "undecodable_image"},
+		{err: ErrSourceTooLarge, status: http.StatusRequestEntityTooLarge, code: "source_too_large"},
+		{err: ErrSourceTooManyPixels, status: http.StatusRequestEntityTooLarge, code: "source_too_many_pixels"},
+		{err: ErrDimensionsTooLarge, status: http.StatusBadRequest, code: "dimensions_too_large"},
+		{err: ErrServerBusy, status: http.StatusServiceUnavailable, code: "server_busy"},
+		{
+			err:    fmt.Errorf("conversion abandoned: %w", context.DeadlineExceeded),
+			status: http.StatusServiceUnavailable, code: "processing_timeout",
+		},
+		{
+			err:    fmt.Errorf("%w: %w", ErrConversion, errors.New("libvips internal error")),
+			status: http.StatusInternalServerError, code: "conversion_failed",
+		},
+		{
+			err:    fmt.Errorf("%w: %w: (frame=3) (frames=2)", ErrConversion, ErrOutOfRange),
+			status: http.StatusBadRequest, code: "bad_request",
+		},
+		{
+			err:    fmt.Errorf("%w: %w", ErrConversion, ErrRegionOutOfBounds),
+			status: http.StatusBadRequest, code: "bad_request",
+		},
+		{err: errors.New("invalid option"), status: http.StatusBadRequest, code: "bad_request"},
+	}
+
+	for _, tc := range tests {
+		status, code := errorStatus(tc.err)
+		require.Equal(t, tc.status, status, tc.err.Error())
+		require.Equal(t, tc.code, code, tc.err.Error())
+	}
+}
+
+func TestServeImageUpstreamFailures(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/large":
+			w.Write(make([]byte, 2048))
+		default:
+			w.Write([]byte("MZ not an image"))
+		}
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	o.MaxSourceBytes, o.NoErrorImage = 1024, true
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{path: "/missing", status: http.StatusNotFound, code: "source_not_found"},
+		{path: "/error", status: http.StatusBadGateway, code: "upstream_status"},
+		{path: "/large", status: http.StatusRequestEntityTooLarge, code: "source_too_large"},
+		{path: "/binary", status: http.StatusBadGateway, code: "not_an_image"},
+	}
+
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		url := ts.URL + tc.path
+		o.serveImage(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/"+url, nil),
+			o.ConvertedImageCache, url, Options{Operation: "fill", Width: 10, Height: 10})
+
+		require.Equal(t, tc.status, w.Code, tc.path)
+		require.Equal(t, tc.code, w.Header().Get(HeaderErrorCode), tc.path)
+		require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"), tc.path)
+		require.Equal(t, w.Header().Get("Error"), w.Body.String(), tc.path)
+	}
+}
+
+func TestWantsProblem(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "*/*", want: false},
+		{accept: "application/json", want: true},
+		{accept: "application/problem+json, */*;q=0.1", want: true},
+		{accept: "image/avif,image/webp,*/*;q=0.8", want: false},
+		{accept: "image/webp;q=0.5, application/json;q=0.9", want: true},
+		{accept: "image/webp, application/json", want: false},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tc.accept)
+		require.Equal(t, tc.want, wantsProblem(r), tc.accept)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	o.ErrorImage = []byte("GIF89a default")
+	o.ErrorImages = map[string][]byte{ErrorClassNotFound: []byte("GIF89a not found")}
+	mux := o.NewServerMux()
+	// the sizes are not applied to the error image as it cannot be decoded
+	path := "/fill/10/10/" + ts.URL + "/missing.jpg"
+
+	// JSON clients get a problem document carrying the client's request ID
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set(HeaderRequestID, "req-1")
+	mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	require.Equal(t, "req-1", w.Header().Get(HeaderRequestID))
+	var p problem
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	require.Equal(t, problem{
+		Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Detail: w.Header().Get("Error"),
+		Code: "source_not_found", Source: ts.URL + "/missing.jpg", RequestID: "req-1",
+	}, p)
+
+	// browsers get the error image of the class
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "GIF89a not found", w.Body.String())
+	require.Len(t, w.Header().Get(HeaderRequestID), 16, "a request ID should be generated")
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fill/x/10/"+ts.URL, nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "GIF89a default", w.Body.String())
+}
@@ -0,0 +1,92 @@
+package internalhttp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheExpiry returns when a source image fetched now with the headers has to be revalidated.
+// The lifetime the origin gives is kept within MinCacheTTL and MaxCacheTTL, images without one
+// live MaxCacheTTL or until evicted if it is 0.
+func (o *Server) cacheExpiry(h http.Header, now time.Time) time.Time {
+	ttl, ok := originTTL(h, now)
+	if !ok {
+		if o.MaxCacheTTL <= 0 {
+			return time.Time{}
+		}
+		ttl = time.Duration(o.MaxCacheTTL) * time.Second
+	}
+	ttl = max(ttl, time.Duration(o.MinCacheTTL)*time.Second)
+	if o.MaxCacheTTL > 0 {
+		ttl = min(ttl, time.Duration(o.MaxCacheTTL)*time.Second)
+	}
+	return now.Add(ttl)
+}
+
+// originTTL returns how long a response may be reused as its Cache-Control or Expires header says,
+// false if the origin gives no lifetime. As a shared cache s-maxage is preferred to max-age.
+func originTTL(h http.Header, now time.Time) (time.Duration, bool) {
+	maxAge, sharedMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.Join(h.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0, true
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sharedMaxAge = parseSeconds(value)
+		}
+	}
+
+	age := time.Duration(max(parseSeconds(h.Get("Age")), 0)) * time.Second
+	switch {
+	case sharedMaxAge >= 0:
+		return max(time.Duration(sharedMaxAge)*time.Second-age, 0), true
+	case maxAge >= 0:
+		return max(time.Duration(maxAge)*time.Second-age, 0), true
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			// an invalid date means already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return max(expires.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// parseSeconds returns the delta-seconds value, -1 if it is invalid.
+func parseSeconds(value string) int {
+	seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return seconds
+}
+
+// conditionalHeaders returns the headers revalidating a cached response with its validators.
+func conditionalHeaders(cached http.Header) http.Header {
+	h := http.Header{}
+	if etag := cached.Get("Etag"); etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified := cached.Get("Last-Modified"); lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+	return h
+}
+
+// sameSource reports whether the headers of a converted image carry the validators of the source
+// headers, that is whether it was converted from the current version of the source.
+func sameSource(converted, source http.Header) bool {
+	etag, lastModified := source.Get("Etag"), source.Get("Last-Modified")
+	return (etag != "" || lastModified != "") &&
+		converted.Get("Etag") == etag && converted.Get("Last-Modified") == lastModified
+}
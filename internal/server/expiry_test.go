@@ -0,0 +1,158 @@
+package internalhttp
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		headers http.Header
+		ttl     time.Duration
+		none    bool
+	}{
+		{headers: http.Header{}, none: true},
+		{headers: http.Header{"Cache-Control": {"public, max-age=600"}}, ttl: 10 * time.Minute},
+		{headers: http.Header{"Cache-Control": {"max-age=600, s-maxage=60"}}, ttl: time.Minute},
+		{headers: http.Header{"Cache-Control": {"max-age=600"}, "Age": {"100"}}, ttl: 500 * time.Second},
+		{headers: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"100"}}, ttl: 0},
+		{headers: http.Header{"Cache-Control": {"no-cache"}}, ttl: 0},
+		{headers: http.Header{"Cache-Control": {"max-age=invalid"}}, none: true},
+		{
+			headers: http.Header{"Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:30:00 GMT"}},
+			ttl:     30 * time.Minute,
+		},
+		{headers: http.Header{"Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}}, ttl: time.Hour},
+		{headers: http.Header{"Expires": {"0"}}, ttl: 0},
+	}
+
+	for _, tc := range tests {
+		ttl, ok := originTTL(tc.headers, now)
+		require.Equal(t, !tc.none, ok, tc.headers)
+		require.Equal(t, tc.ttl, ttl, tc.headers)
+	}
+
+	o := &Server{MinCacheTTL: 60, MaxCacheTTL: 3600}
+	require.Equal(t, now.Add(time.Minute), o.cacheExpiry(http.Header{"Cache-Control": {"max-age=1"}}, now))
+	require.Equal(t, now.Add(time.Hour), o.cacheExpiry(http.Header{"Cache-Control": {"max-age=86400"}}, now))
+	require.Equal(t, now.Add(time.Hour), o.cacheExpiry(http.Header{}, now))
+	require.True(t, (&Server{}).cacheExpiry(http.Header{}, now).IsZero(), "without limits the image never expires")
+}
+
+func TestGetBaseImageRevalidates(t *testing.T) {
+	t.Parallel()
+	var downloads, revalidations int32
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := etag.Load().(string)
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Etag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&revalidations, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		png, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+		w.Write(png)
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+
+	// the conditions of the client are not passed to the source server
+	h := &http.Header{"If-None-Match": {`"v1"`}}
+	base, err := o.getBaseImage(context.Background(), ts.URL, h)
+	require.NoError(t, err)
+	require.NotEmpty(t, base.image)
+	require.False(t, base.expires.IsZero())
+
+	// the expired image is revalidated instead of downloaded again
+	base, err = o.getBaseImage(context.Background(), ts.URL, h)
+	require.NoError(t, err)
+	require.NotEmpty(t, base.image)
+	require.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+	require.Equal(t, int32(1), atomic.LoadInt32(&revalidations))
+
+	// a refreshed lifetime skips the revalidation
+	o.MinCacheTTL = 60
+	_, err = o.getBaseImage(context.Background(), ts.URL, h)
+	require.NoError(t, err)
+	_, err = o.getBaseImage(context.Background(), ts.URL, h)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&revalidations))
+
+	ci, _ := o.BaseImageCache.Get(ts.URL)
+	ci.Expires = time.Now()
+	o.BaseImageCache.Set(ts.URL, ci)
+	etag.Store(`"v2"`)
+	_, err = o.getBaseImage(context.Background(), ts.URL, h)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&downloads), "a changed image should be downloaded again")
+}
+
+func TestConvertImageRevalidated(t *testing.T) {
+	t.Parallel()
+	var downloads int32
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := etag.Load().(string)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Etag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		png, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+		w.Write(png)
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	opts := Options{Operation: "fit", Width: 10, Height: 10}
+	key := opts.cacheKey() + "-" + ts.URL
+	convert := func() sharedResult {
+		res, err := o.convertImage(context.Background(), o.ConvertedImageCache, key, ts.URL, &http.Header{}, opts,
+			o.getBaseImage)
+		require.NoError(t, err)
+		return res
+	}
+	expire := func(cache Cache, key string) {
+		ci, _ := cache.Get(key)
+		ci.Expires = time.Now()
+		cache.Set(key, ci)
+	}
+
+	converted := convert()
+	require.NotEqual(t, []byte("kept"), converted.image)
+	ci, _ := o.ConvertedImageCache.Get(key)
+	ci.Content = []byte("kept")
+	o.ConvertedImageCache.Set(key, ci)
+
+	// an unchanged source refreshes the expiry of the converted image instead of converting it again
+	expire(o.BaseImageCache, ts.URL)
+	expire(o.ConvertedImageCache, key)
+	converted = convert()
+	require.Equal(t, []byte("kept"), converted.image)
+	require.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+	ci, _ = o.ConvertedImageCache.Get(key)
+	require.WithinDuration(t, time.Now().Add(time.Minute), ci.Expires, 10*time.Second)
+
+	// a changed source is converted again
+	etag.Store(`"v2"`)
+	expire(o.BaseImageCache, ts.URL)
+	converted = convert()
+	require.NotEqual(t, []byte("kept"), converted.image)
+	require.Equal(t, int32(2), atomic.LoadInt32(&downloads))
+}
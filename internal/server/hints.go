@@ -0,0 +1,80 @@
+package internalhttp
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	hintDPR           = "Sec-CH-DPR"
+	hintWidth         = "Sec-CH-Width"
+	hintViewportWidth = "Sec-CH-Viewport-Width"
+	hintSaveData      = "Save-Data"
+)
+
+var clientHints = strings.Join([]string{hintDPR, hintWidth, hintViewportWidth, hintSaveData}, ", ")
+
+// advertiseClientHints asks the browser to send the client hints we use
+// and marks the response as depending on them.
+func (o *Server) advertiseClientHints(w http.ResponseWriter) {
+	if !o.ClientHints {
+		return
+	}
+	w.Header().Set("Accept-CH", clientHints)
+	w.Header().Add("Vary", clientHints)
+}
+
+// applyDeviceHints multiplies the requested dimensions by the device pixel ratio.
+// With client hints enabled the ratio may come from the request headers, the dimensions
+// are fitted into the hinted widths and the quality is lowered if the client asks to save data.
+func (o *Server) applyDeviceHints(h http.Header, opts *Options) {
+	dpr := opts.DPR
+	if dpr == 0 && o.ClientHints {
+		dpr = parseHintFloat(h.Get(hintDPR))
+	}
+	if dpr <= 0 {
+		dpr = 1
+	}
+	if o.MaxDPR > 0 && dpr > o.MaxDPR {
+		dpr = o.MaxDPR
+	}
+	opts.DPR = dpr
+	opts.Width = scaleDimension(opts.Width, dpr)
+	opts.Height = scaleDimension(opts.Height, dpr)
+
+	if !o.ClientHints {
+		return
+	}
+
+	// Sec-CH-Width is already in physical pixels while the viewport width is in CSS pixels
+	fitWidth(opts, int(parseHintFloat(h.Get(hintWidth))))
+	fitWidth(opts, scaleDimension(int(parseHintFloat(h.Get(hintViewportWidth))), dpr))
+
+	if strings.EqualFold(h.Get(hintSaveData), "on") && o.SaveDataQuality > 0 &&
+		(opts.Quality == 0 || opts.Quality > o.SaveDataQuality) {
+		opts.Quality = o.SaveDataQuality
+	}
+}
+
+// fitWidth reduces the requested size keeping its aspect ratio so the width is not over the limit.
+func fitWidth(opts *Options, limit int) {
+	if limit <= 0 || opts.Width <= limit {
+		return
+	}
+	opts.Height = int(math.Round(float64(opts.Height) * float64(limit) / float64(opts.Width)))
+	opts.Width = limit
+}
+
+func scaleDimension(v int, dpr float64) int {
+	return int(math.Round(float64(v) * dpr))
+}
+
+func parseHintFloat(v string) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0
+	}
+	return f
+}
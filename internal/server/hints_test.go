@@ -0,0 +1,74 @@
+package internalhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyDeviceHints(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		hints   bool
+		dpr     float64
+		headers map[string]string
+		want    Options
+	}{
+		{name: "no dpr", want: Options{Width: 100, Height: 50, DPR: 1}},
+		{name: "dpr", dpr: 2, want: Options{Width: 200, Height: 100, DPR: 2}},
+		{name: "dpr over cap", dpr: 5, want: Options{Width: 300, Height: 150, DPR: 3}},
+		{
+			name: "hints ignored when disabled", headers: map[string]string{hintDPR: "2", hintSaveData: "on"},
+			want: Options{Width: 100, Height: 50, DPR: 1},
+		},
+		{
+			name: "dpr hint", hints: true, headers: map[string]string{hintDPR: "2"},
+			want: Options{Width: 200, Height: 100, DPR: 2},
+		},
+		{
+			name: "query dpr wins over hint", hints: true, dpr: 1.5, headers: map[string]string{hintDPR: "2"},
+			want: Options{Width: 150, Height: 75, DPR: 1.5},
+		},
+		{
+			name: "width hint", hints: true, headers: map[string]string{hintDPR: "2", hintWidth: "120"},
+			want: Options{Width: 120, Height: 60, DPR: 2},
+		},
+		{
+			name: "viewport width hint", hints: true, headers: map[string]string{hintDPR: "2", hintViewportWidth: "40"},
+			want: Options{Width: 80, Height: 40, DPR: 2},
+		},
+		{
+			name: "save data", hints: true, headers: map[string]string{hintSaveData: "on"},
+			want: Options{Width: 100, Height: 50, DPR: 1, Quality: 50},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Server{ClientHints: tc.hints, MaxDPR: 3, SaveDataQuality: 50}
+			h := make(http.Header)
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			opts := Options{Width: 100, Height: 50, DPR: tc.dpr}
+			o.applyDeviceHints(h, &opts)
+			require.Equal(t, tc.want, opts)
+		})
+	}
+}
+
+func TestAdvertiseClientHints(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	(&Server{}).advertiseClientHints(w)
+	require.Empty(t, w.Header().Get("Accept-CH"))
+
+	(&Server{ClientHints: true}).advertiseClientHints(w)
+	require.Contains(t, w.Header().Get("Accept-CH"), hintWidth)
+	require.Contains(t, w.Header().Get("Vary"), hintSaveData)
+}
@@ -0,0 +1,356 @@
+package internalhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	iiifPrefix    = "/iiif/"
+	iiifInfo      = "info.json"
+	iiifOperation = "iiif"
+
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+	iiifProfile  = "level2"
+
+	// keeps sizes scaled exactly to a limit from being rounded down below it
+	iiifScaleEpsilon = 1e-9
+)
+
+var (
+	iiifFormats = map[string]ImageType{
+		"jpg":  JPEG,
+		"png":  PNG,
+		"gif":  GIF,
+		"webp": WEBP,
+	}
+
+	iiifExtraFormats   = []string{"gif", "webp"}
+	iiifExtraQualities = []string{"color", "gray"}
+	iiifExtraFeatures  = []string{"mirroring", "sizeUpscaling"}
+)
+
+// iiifRequest is an IIIF Image API request:
+// {identifier}/{region}/{size}/{rotation}/{quality}.{format} or {identifier}/info.json.
+type iiifRequest struct {
+	Identifier string
+	Info       bool
+	Region     string
+	Size       string
+	Rotation   string
+	Quality    string
+	Format     string
+}
+
+// iiifLimits are the largest sizes advertised in the image information, 0 means unlimited.
+type iiifLimits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxArea   int64
+}
+
+// iiifImageInfo is the image information document returned for info.json requests.
+type iiifImageInfo struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	ExtraFormats   []string `json:"extraFormats"`
+	ExtraQualities []string `json:"extraQualities"`
+	ExtraFeatures  []string `json:"extraFeatures"`
+	MaxWidth       int      `json:"maxWidth,omitempty"`
+	MaxHeight      int      `json:"maxHeight,omitempty"`
+	MaxArea        int64    `json:"maxArea,omitempty"`
+}
+
+// iiifRoute serves the IIIF Image API 3.0 endpoint. The identifier is the URL-encoded address of the
+// source image, the same address the resize endpoint takes, so both endpoints share the caches.
+func (o *Server) iiifRoute() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if r.Method != "GET" {
+			o.Log.Error(fmt.Sprintf("unsupported method %s", r.Method))
+			o.failedRequest(w, r, "the method is not allowed")
+			return
+		}
+
+		req, redirect, err := parseIIIFPath(r.URL.EscapedPath())
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedRequest(w, r, err.Error())
+			return
+		}
+		if redirect {
+			// the base URI of an image redirects to its image information
+			http.Redirect(w, r, r.URL.EscapedPath()+"/"+iiifInfo, http.StatusSeeOther)
+			return
+		}
+
+		size, err := o.getBaseImageSize(r.Context(), req.Identifier, &r.Header)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedSource(w, r, req.Identifier, err)
+			return
+		}
+
+		if req.Info {
+			o.writeIIIFInfo(w, r, req.Identifier, size)
+			return
+		}
+
+		opts, err := req.options(size.Width, size.Height, iiifLimits{o.MaxWidth, o.MaxHeight, o.MaxArea})
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failed(w, r, req.Identifier, opts, err)
+			return
+		}
+
+		o.Log.Info(fmt.Sprintf("will serve IIIF %s/%s/%s/%s.%s of image at %s",
+			req.Region, req.Size, req.Rotation, req.Quality, req.Format, req.Identifier))
+
+		o.serveImage(w, r, o.ConvertedImageCache, req.Identifier, opts)
+	}
+}
+
+func (o *Server) writeIIIFInfo(w http.ResponseWriter, r *http.Request, identifier string, size ImageSize) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	info := iiifImageInfo{
+		Context:        iiifContext,
+		ID:             scheme + "://" + r.Host + iiifPrefix + url.PathEscape(identifier),
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        iiifProfile,
+		Width:          size.Width,
+		Height:         size.Height,
+		ExtraFormats:   iiifExtraFormats,
+		ExtraQualities: iiifExtraQualities,
+		ExtraFeatures:  iiifExtraFeatures,
+		MaxWidth:       o.MaxWidth,
+		MaxHeight:      o.MaxHeight,
+		MaxArea:        o.MaxArea,
+	}
+
+	body, _ := json.Marshal(info)
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		w.Header().Set("Content-Type", `application/ld+json;profile="`+iiifContext+`"`)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(body)
+}
+
+// parseIIIFPath splits the escaped request path into the IIIF request parameters.
+// It reports a redirect if only the identifier was requested.
+func parseIIIFPath(escapedPath string) (iiifRequest, bool, error) {
+	var req iiifRequest
+	parts := strings.Split(strings.TrimPrefix(escapedPath, iiifPrefix), "/")
+
+	identifier, err := url.PathUnescape(parts[0])
+	if err != nil || identifier == "" {
+		return req, false, fmt.Errorf("invalid IIIF identifier provided: (identifier=%s)", parts[0])
+	}
+	req.Identifier = identifier
+
+	switch {
+	case len(parts) == 1:
+		return req, true, nil
+	case len(parts) == 2 && parts[1] == iiifInfo:
+		req.Info = true
+		return req, false, nil
+	case len(parts) == 5:
+		req.Region, req.Size, req.Rotation = parts[1], parts[2], parts[3]
+		quality, format, found := strings.Cut(parts[4], ".")
+		if !found {
+			return req, false, fmt.Errorf("invalid IIIF quality and format provided: (quality=%s)", parts[4])
+		}
+		req.Quality, req.Format = quality, format
+		return req, false, nil
+	}
+	return req, false, fmt.Errorf("invalid IIIF request: (path=%s)", escapedPath)
+}
+
+// options converts the request into resize options for a source image of the given size.
+func (req iiifRequest) options(width, height int, limits iiifLimits) (Options, error) {
+	opts := Options{Operation: iiifOperation, Force: true, NoTrim: true}
+
+	region, err := iiifRegion(req.Region, width, height)
+	if err != nil {
+		return opts, err
+	}
+	if region != image.Rect(0, 0, width, height) {
+		opts.Extract = Region{
+			Left: float64(region.Min.X), Top: float64(region.Min.Y),
+			Width: float64(region.Dx()), Height: float64(region.Dy()),
+		}
+	}
+
+	opts.Width, opts.Height, err = iiifSize(req.Size, region.Dx(), region.Dy(), limits)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Rotate, opts.Mirror, err = iiifRotation(req.Rotation)
+	if err != nil {
+		return opts, err
+	}
+	// the size applies to the region before it is rotated
+	if opts.Rotate%180 != 0 {
+		opts.Width, opts.Height = opts.Height, opts.Width
+	}
+
+	switch req.Quality {
+	case "default", "color":
+	case "gray":
+		opts.Grayscale = true
+	default:
+		return opts, fmt.Errorf("unsupported IIIF quality: (quality=%s)", req.Quality)
+	}
+
+	format, ok := iiifFormats[req.Format]
+	if !ok {
+		return opts, fmt.Errorf("unsupported output format: (format=%s)", req.Format)
+	}
+	opts.Format = format
+	return opts, nil
+}
+
+// iiifRegion resolves the region parameter against the source dimensions.
+// Regions extending beyond the image are cropped at its edges.
+func iiifRegion(value string, width, height int) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+	switch value {
+	case "full":
+		return bounds, nil
+	case "square":
+		side := min(width, height)
+		left, top := (width-side)/2, (height-side)/2
+		return image.Rect(left, top, left+side, top+side), nil
+	}
+
+	region, err := parseRegion(value)
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("invalid IIIF region provided: (region=%s)", value)
+	}
+	left, top, w, h := region.Left, region.Top, region.Width, region.Height
+	if region.Percent {
+		left, w = left*float64(width)/100, w*float64(width)/100
+		top, h = top*float64(height)/100, h*float64(height)/100
+	}
+	rect := image.Rect(int(math.Round(left)), int(math.Round(top)),
+		int(math.Round(left+w)), int(math.Round(top+h))).Intersect(bounds)
+	if rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("%w: (region=%s) (image=%dx%d)", ErrRegionOutOfBounds, value, width, height)
+	}
+	return rect, nil
+}
+
+// iiifSize resolves the size parameter against the dimensions of the region.
+// Sizes larger than the region are only allowed with the ^ prefix, max is the largest size within the limits.
+func iiifSize(value string, width, height int, limits iiifLimits) (int, int, error) {
+	invalid := fmt.Errorf("invalid IIIF size provided: (size=%s)", value)
+	upscale := strings.HasPrefix(value, "^")
+	v := strings.TrimPrefix(value, "^")
+
+	var w, h int
+	switch {
+	case v == "max" || v == "full":
+		scale := limits.scale(width, height)
+		if !upscale || math.IsInf(scale, 1) {
+			scale = math.Min(scale, 1)
+		}
+		// rounded down to stay within the limits
+		w = max(int(math.Floor(float64(width)*scale+iiifScaleEpsilon)), 1)
+		h = max(int(math.Floor(float64(height)*scale+iiifScaleEpsilon)), 1)
+	case strings.HasPrefix(v, "pct:"):
+		pct, err := strconv.ParseFloat(strings.TrimPrefix(v, "pct:"), 64)
+		if err != nil || pct <= 0 || math.IsInf(pct, 0) {
+			return 0, 0, invalid
+		}
+		w = int(math.Round(float64(width) * pct / 100))
+		h = int(math.Round(float64(height) * pct / 100))
+	default:
+		confined := strings.HasPrefix(v, "!")
+		sw, sh, found := strings.Cut(strings.TrimPrefix(v, "!"), ",")
+		if !found {
+			return 0, 0, invalid
+		}
+		var err error
+		if sw != "" {
+			if w, err = strconv.Atoi(sw); err != nil || w < 1 {
+				return 0, 0, invalid
+			}
+		}
+		if sh != "" {
+			if h, err = strconv.Atoi(sh); err != nil || h < 1 {
+				return 0, 0, invalid
+			}
+		}
+
+		switch {
+		case confined && w > 0 && h > 0:
+			// the largest size keeping the aspect ratio within w,h and, unless upscaling, within the region
+			scale := math.Min(float64(w)/float64(width), float64(h)/float64(height))
+			if !upscale {
+				scale = math.Min(scale, 1)
+			}
+			w = int(math.Round(float64(width) * scale))
+			h = int(math.Round(float64(height) * scale))
+		case confined:
+			return 0, 0, invalid
+		case w > 0 && h == 0:
+			h = int(math.Round(float64(height) * float64(w) / float64(width)))
+		case w == 0 && h > 0:
+			w = int(math.Round(float64(width) * float64(h) / float64(height)))
+		case w == 0 && h == 0:
+			return 0, 0, invalid
+		}
+	}
+
+	if w < 1 || h < 1 {
+		return 0, 0, invalid
+	}
+	if !upscale && (w > width || h > height) {
+		return 0, 0, fmt.Errorf("IIIF size is larger than the region, use ^ to upscale: (size=%s) (region=%dx%d)",
+			value, width, height)
+	}
+	return w, h, nil
+}
+
+// scale returns the factor fitting the size within the limits, +Inf without limits.
+func (l iiifLimits) scale(width, height int) float64 {
+	scale := math.Inf(1)
+	if l.MaxWidth > 0 {
+		scale = math.Min(scale, float64(l.MaxWidth)/float64(width))
+	}
+	if l.MaxHeight > 0 {
+		scale = math.Min(scale, float64(l.MaxHeight)/float64(height))
+	}
+	if l.MaxArea > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(l.MaxArea)/(float64(width)*float64(height))))
+	}
+	return scale
+}
+
+// iiifRotation parses the rotation parameter, only multiples of 90 degrees are supported.
+func iiifRotation(value string) (int, bool, error) {
+	mirror := strings.HasPrefix(value, "!")
+	degrees, err := strconv.ParseFloat(strings.TrimPrefix(value, "!"), 64)
+	if err != nil || degrees < 0 || degrees > 360 || math.Mod(degrees, 90) != 0 {
+		return 0, false, fmt.Errorf("unsupported IIIF rotation: (rotation=%s)", value)
+	}
+	return int(degrees) % 360, mirror, nil
+}
@@ -0,0 +1,143 @@
+package internalhttp
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIIIFPath(t *testing.T) {
+	t.Parallel()
+	req, redirect, err := parseIIIFPath("/iiif/example.com%2Fimages%2Fa.jpg/10,20,30,40/max/!90/gray.png")
+	require.NoError(t, err)
+	require.False(t, redirect)
+	require.Equal(t, iiifRequest{
+		Identifier: "example.com/images/a.jpg", Region: "10,20,30,40", Size: "max",
+		Rotation: "!90", Quality: "gray", Format: "png",
+	}, req)
+
+	req, redirect, err = parseIIIFPath("/iiif/example.com%2Fa.jpg/info.json")
+	require.NoError(t, err)
+	require.False(t, redirect)
+	require.True(t, req.Info)
+
+	_, redirect, err = parseIIIFPath("/iiif/example.com%2Fa.jpg")
+	require.NoError(t, err)
+	require.True(t, redirect)
+
+	for _, path := range []string{"/iiif/", "/iiif/a.jpg/full/max", "/iiif/a.jpg/full/max/0/default"} {
+		_, _, err = parseIIIFPath(path)
+		require.Error(t, err, path)
+	}
+}
+
+func TestIIIFRegion(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		value   string
+		want    image.Rectangle
+		invalid bool
+	}{
+		{value: "full", want: image.Rect(0, 0, 400, 200)},
+		{value: "square", want: image.Rect(100, 0, 300, 200)},
+		{value: "10,20,30,40", want: image.Rect(10, 20, 40, 60)},
+		{value: "pct:25,50,50,50", want: image.Rect(100, 100, 300, 200)},
+		{value: "300,100,200,200", want: image.Rect(300, 100, 400, 200)},
+		{value: "400,0,10,10", invalid: true},
+		{value: "10,20,30", invalid: true},
+	}
+
+	for _, tc := range tests {
+		rect, err := iiifRegion(tc.value, 400, 200)
+		if tc.invalid {
+			require.Error(t, err, tc.value)
+			continue
+		}
+		require.NoError(t, err, tc.value)
+		require.Equal(t, tc.want, rect, tc.value)
+	}
+}
+
+func TestIIIFSize(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		value   string
+		w, h    int
+		invalid bool
+	}{
+		{value: "max", w: 400, h: 200},
+		{value: "full", w: 400, h: 200},
+		{value: "200,", w: 200, h: 100},
+		{value: ",50", w: 100, h: 50},
+		{value: "pct:50", w: 200, h: 100},
+		{value: "100,100", w: 100, h: 100},
+		{value: "!100,100", w: 100, h: 50},
+		{value: "!800,800", w: 400, h: 200},
+		{value: "^!800,800", w: 800, h: 400},
+		{value: "^800,", w: 800, h: 400},
+		{value: "^pct:200", w: 800, h: 400},
+		{value: "800,", invalid: true},
+		{value: "pct:200", invalid: true},
+		{value: "!100,", invalid: true},
+		{value: ",", invalid: true},
+		{value: "0,10", invalid: true},
+		{value: "pct:0", invalid: true},
+		{value: "big", invalid: true},
+	}
+
+	for _, tc := range tests {
+		w, h, err := iiifSize(tc.value, 400, 200, iiifLimits{})
+		if tc.invalid {
+			require.Error(t, err, tc.value)
+			continue
+		}
+		require.NoError(t, err, tc.value)
+		require.Equal(t, []int{tc.w, tc.h}, []int{w, h}, tc.value)
+	}
+
+	// max and full are scaled down to the advertised limits, ^max up to them
+	limited := []struct {
+		value  string
+		limits iiifLimits
+		w, h   int
+	}{
+		{value: "max", limits: iiifLimits{MaxWidth: 300}, w: 300, h: 150},
+		{value: "full", limits: iiifLimits{MaxHeight: 100}, w: 200, h: 100},
+		{value: "max", limits: iiifLimits{MaxArea: 20000}, w: 200, h: 100},
+		{value: "max", limits: iiifLimits{MaxWidth: 1000}, w: 400, h: 200},
+		{value: "^max", limits: iiifLimits{MaxWidth: 1000, MaxHeight: 300}, w: 600, h: 300},
+		{value: "^max", limits: iiifLimits{}, w: 400, h: 200},
+	}
+	for _, tc := range limited {
+		w, h, err := iiifSize(tc.value, 400, 200, tc.limits)
+		require.NoError(t, err, tc.value)
+		require.Equal(t, []int{tc.w, tc.h}, []int{w, h}, "%s %+v", tc.value, tc.limits)
+	}
+}
+
+func TestIIIFRequestOptions(t *testing.T) {
+	t.Parallel()
+	req := iiifRequest{Region: "0,0,200,100", Size: "100,", Rotation: "!90", Quality: "gray", Format: "webp"}
+	opts, err := req.options(400, 200, iiifLimits{})
+	require.NoError(t, err)
+	require.Equal(t, Options{
+		Operation: iiifOperation, Force: true, NoTrim: true, Width: 50, Height: 100,
+		Extract: Region{Width: 200, Height: 100}, Rotate: 90, Mirror: true, Grayscale: true,
+		Format: WEBP,
+	}, opts)
+
+	req = iiifRequest{Region: "full", Size: "max", Rotation: "0", Quality: "default", Format: "jpg"}
+	opts, err = req.options(400, 200, iiifLimits{})
+	require.NoError(t, err)
+	require.False(t, opts.Extract.isSet())
+
+	for _, bad := range []iiifRequest{
+		{Region: "full", Size: "max", Rotation: "45", Quality: "default", Format: "jpg"},
+		{Region: "full", Size: "max", Rotation: "0", Quality: "bitonal", Format: "jpg"},
+		{Region: "full", Size: "max", Rotation: "0", Quality: "default", Format: "tif"},
+	} {
+		_, err = bad.options(400, 200, iiifLimits{})
+		require.Error(t, err)
+	}
+}
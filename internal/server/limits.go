@@ -0,0 +1,75 @@
+package internalhttp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrDimensionsTooLarge = errors.New("requested dimensions are too large")
+
+// checkDimensions validates the requested output size against the configured limits. A zero
+// dimension is derived from the aspect ratio of the source, it is checked by checkOutputSize
+// once the source is known. Negative dimensions are invalid.
+func (o *Server) checkDimensions(width, height int) error {
+	if width < 0 || height < 0 {
+		return fmt.Errorf("invalid width or height provided: (width=%d) (height=%d)", width, height)
+	}
+	if (o.MaxWidth > 0 && width > o.MaxWidth) || (o.MaxHeight > 0 && height > o.MaxHeight) ||
+		(o.MaxArea > 0 && int64(width)*int64(height) > o.MaxArea) {
+		return fmt.Errorf("%w: (size=%dx%d) (max size=%dx%d) (max area=%d)",
+			ErrDimensionsTooLarge, width, height, o.MaxWidth, o.MaxHeight, o.MaxArea)
+	}
+	return nil
+}
+
+// checkOutputSize validates the output size the options produce from the source image,
+// zero dimensions are derived from its size.
+func (o *Server) checkOutputSize(opts Options, image []byte) error {
+	if o.MaxWidth <= 0 && o.MaxHeight <= 0 && o.MaxArea <= 0 {
+		return nil
+	}
+	if opts.Width > 0 && opts.Height > 0 {
+		return o.checkDimensions(outputSize(opts, ImageSize{}))
+	}
+	size, err := processingEngine().Size(image)
+	if err != nil {
+		return err
+	}
+	width, height := outputSize(opts, size)
+	return o.checkDimensions(width, height)
+}
+
+// outputSize returns the size of the converted image, the padding and the border surround the resized one.
+func outputSize(opts Options, size ImageSize) (int, int) {
+	w, h := resizedSize(opts, size)
+	inset := 2 * (opts.Padding + opts.Border)
+	return w + inset, h + inset
+}
+
+// resizedSize returns the requested size with a zero dimension derived from the aspect ratio of
+// the extracted and rotated source, if both are zero the result has the size of the source.
+func resizedSize(opts Options, size ImageSize) (int, int) {
+	w, h := size.Width, size.Height
+	if opts.Extract.isSet() {
+		if rect, err := opts.Extract.rect(w, h); err == nil {
+			w, h = rect.Dx(), rect.Dy()
+		}
+	}
+	if opts.Rotate%180 != 0 {
+		w, h = h, w
+	}
+	if w <= 0 || h <= 0 {
+		return opts.Width, opts.Height
+	}
+
+	switch {
+	case opts.Width > 0 && opts.Height == 0:
+		return opts.Width, int(math.Round(float64(h) * float64(opts.Width) / float64(w)))
+	case opts.Width == 0 && opts.Height > 0:
+		return int(math.Round(float64(w) * float64(opts.Height) / float64(h))), opts.Height
+	case opts.Width == 0 && opts.Height == 0:
+		return w, h
+	}
+	return opts.Width, opts.Height
+}
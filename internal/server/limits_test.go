@@ -0,0 +1,77 @@
+package internalhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Dmit1812/imgresizr/internal/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDimensions(t *testing.T) {
+	t.Parallel()
+	o := &Server{MaxWidth: 1000, MaxHeight: 800, MaxArea: 500000}
+	require.NoError(t, o.checkDimensions(1000, 0))
+	require.NoError(t, o.checkDimensions(0, 800))
+	require.NoError(t, o.checkDimensions(1000, 500))
+	require.ErrorIs(t, o.checkDimensions(1001, 0), ErrDimensionsTooLarge)
+	require.ErrorIs(t, o.checkDimensions(0, 801), ErrDimensionsTooLarge)
+	require.ErrorIs(t, o.checkDimensions(1000, 501), ErrDimensionsTooLarge)
+	require.Error(t, o.checkDimensions(-1, 100))
+
+	unlimited := &Server{}
+	require.NoError(t, unlimited.checkDimensions(60000, 60000))
+	require.Error(t, unlimited.checkDimensions(100, -1))
+
+	_, _, err := parseDimensions("-100x100")
+	require.Error(t, err)
+}
+
+func TestOutputSize(t *testing.T) {
+	t.Parallel()
+	size := ImageSize{Width: 400, Height: 200}
+	tests := []struct {
+		opts Options
+		w, h int
+	}{
+		{opts: Options{Width: 100, Height: 100}, w: 100, h: 100},
+		{opts: Options{Width: 100}, w: 100, h: 50},
+		{opts: Options{Height: 100}, w: 200, h: 100},
+		{opts: Options{}, w: 400, h: 200},
+		{opts: Options{Width: 100, Rotate: 90}, w: 100, h: 200},
+		{opts: Options{Width: 100, Extract: Region{Width: 50, Height: 100, Percent: true}}, w: 100, h: 100},
+		{opts: Options{Width: 100, Height: 100, Padding: 10, Border: 5}, w: 130, h: 130},
+		{opts: Options{Width: 100, Border: 5}, w: 110, h: 60},
+	}
+
+	for _, tc := range tests {
+		w, h := outputSize(tc.opts, size)
+		require.Equal(t, []int{tc.w, tc.h}, []int{w, h}, "%+v", tc.opts)
+	}
+}
+
+func TestServeImageRejectsLargeDimensions(t *testing.T) {
+	t.Parallel()
+	var fetched int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+	}))
+	defer ts.Close()
+
+	o := &Server{MaxWidth: 1000, MaxHeight: 1000, Log: logger.New(logger.ERROR)}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/fill/60000/60000/"+ts.URL, nil)
+	o.serveImage(w, r, nil, ts.URL, Options{Operation: "fill", Width: 60000, Height: 60000})
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Header().Get("Error"), ErrDimensionsTooLarge.Error())
+	require.Zero(t, atomic.LoadInt32(&fetched), "the source should not be fetched")
+
+	// the padding and the border count as well
+	w = httptest.NewRecorder()
+	o.serveImage(w, r, nil, ts.URL, Options{Operation: "fill", Width: 1000, Height: 1000, Padding: 1})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Zero(t, atomic.LoadInt32(&fetched), "the source should not be fetched")
+}
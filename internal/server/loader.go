@@ -2,12 +2,20 @@ package internalhttp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
+)
+
+var (
+	ErrSourceTooLarge      = errors.New("source image is too large")
+	ErrSourceTooManyPixels = errors.New("source image has too many pixels")
+
+	// the source server confirmed the cached image is still current.
+	errNotModified = errors.New("source image is not modified")
 )
 
 func addHTTPSToURL(url string) string {
@@ -17,48 +25,112 @@ func addHTTPSToURL(url string) string {
 	return url
 }
 
-func (o *Server) LoadImageFromNetwork(imageURL string, h *http.Header) ([]byte, *http.Header, error) {
+// LoadImageFromNetwork downloads the image, the download stops when ctx is done or the fetch budget is over.
+func (o *Server) LoadImageFromNetwork(
+	ctx context.Context, imageURL string, h *http.Header,
+) ([]byte, *http.Header, error) {
+	return o.loadImageIfModified(ctx, imageURL, h, nil)
+}
+
+// loadImageIfModified downloads the image sending the conditional headers along,
+// errNotModified is returned if the source server answers it has not changed.
+func (o *Server) loadImageIfModified(
+	ctx context.Context, imageURL string, h *http.Header, conditions http.Header,
+) ([]byte, *http.Header, error) {
 	url, err := url.Parse(addHTTPSToURL(imageURL))
 	if err != nil {
-		return nil, &http.Header{}, fmt.Errorf("invalid image URL: (url=%s)", url.RequestURI())
+		return nil, &http.Header{}, fmt.Errorf("invalid image URL: (url=%s)", imageURL)
 	}
-	return o.loadImage(url, h)
+	return o.loadImage(ctx, url, h, conditions)
 }
 
-func (o *Server) loadImage(url *url.URL, h *http.Header) ([]byte, *http.Header, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.HTTPReadTimeout)*time.Second)
+func (o *Server) loadImage(
+	ctx context.Context, url *url.URL, h *http.Header, conditions http.Header,
+) ([]byte, *http.Header, error) {
+	fetchTimeout := o.FetchTimeout
+	if fetchTimeout <= 0 {
+		fetchTimeout = o.HTTPReadTimeout
+	}
+	ctx, cancel := stageContext(ctx, fetchTimeout)
 	defer cancel()
 	req := o.createRequest(ctx, url, h)
-	res, err := http.DefaultClient.Do(req)
+	for key, values := range conditions {
+		req.Header[key] = values
+	}
+	res, err := o.doUpstream(ctx, req)
 	// if err != nil the res will be undefined
 	if err != nil {
 		if res != nil {
-			return nil, &res.Header, fmt.Errorf("error downloading image: %w", err)
+			return nil, &res.Header, fmt.Errorf("%w: %w", ErrUpstream, err)
 		}
-		return nil, &http.Header{}, fmt.Errorf("error downloading image: %w", err)
+		return nil, &http.Header{}, fmt.Errorf("%w: %w", ErrUpstream, err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && len(conditions) > 0 {
+		return nil, &res.Header, errNotModified
+	}
 	if res.StatusCode != 200 {
-		return nil, &res.Header,
-			fmt.Errorf("error downloading image: (status=%d) (url=%s)", res.StatusCode, req.URL.RequestURI())
+		return nil, &res.Header, &UpstreamStatusError{Status: res.StatusCode, URL: req.URL.RequestURI()}
 	}
 
-	buf, err := io.ReadAll(res.Body)
+	// refuse early what the server announces as too large, the limited reader catches the rest
+	if o.MaxSourceBytes > 0 && res.ContentLength > o.MaxSourceBytes {
+		return nil, &res.Header, fmt.Errorf("%w: (size=%d) (max bytes=%d) (url=%s)",
+			ErrSourceTooLarge, res.ContentLength, o.MaxSourceBytes, req.URL.RequestURI())
+	}
+	body := io.Reader(res.Body)
+	if o.MaxSourceBytes > 0 {
+		body = io.LimitReader(res.Body, o.MaxSourceBytes+1)
+	}
+
+	buf, err := io.ReadAll(body)
 	if err != nil {
 		return nil, &res.Header,
-			fmt.Errorf("unable to create image from response body: %w (url=%s)", err, req.URL.RequestURI())
+			fmt.Errorf("%w: unable to read response body: %w (url=%s)", ErrUpstream, err, req.URL.RequestURI())
+	}
+	if o.MaxSourceBytes > 0 && int64(len(buf)) > o.MaxSourceBytes {
+		return nil, &res.Header, fmt.Errorf("%w: (max bytes=%d) (url=%s)",
+			ErrSourceTooLarge, o.MaxSourceBytes, req.URL.RequestURI())
 	}
 	return buf, &res.Header, nil
 }
 
+// checkSourcePixels rejects images whose decoded size exceeds the configured pixel limit,
+// only the header is read so nothing is allocated for the pixels. Every frame of an animation
+// is decoded onto the full canvas and counts.
+func (o *Server) checkSourcePixels(image []byte, url string) error {
+	if o.MaxSourcePixels <= 0 {
+		return nil
+	}
+	size, err := processingEngine().Size(image)
+	if err != nil {
+		return fmt.Errorf("%w: %w (url=%s)", ErrUndecodable, err, url)
+	}
+	pixels := int64(size.Width) * int64(size.Height)
+	frames, canvas := animationFrames(image)
+	if frames > 1 {
+		pixels = int64(frames) * int64(canvas.X) * int64(canvas.Y)
+	}
+	if pixels > o.MaxSourcePixels {
+		return fmt.Errorf("%w: (size=%dx%d) (frames=%d) (max pixels=%d) (url=%s)",
+			ErrSourceTooManyPixels, size.Width, size.Height, max(frames, 1), o.MaxSourcePixels, url)
+	}
+	return nil
+}
+
 func (o *Server) createRequest(ctx context.Context, url *url.URL, h *http.Header) *http.Request {
 	req, _ := http.NewRequestWithContext(ctx, "GET", url.RequestURI(), nil)
 
 	if h != nil {
 		CopyHeaders(h, req)
 	}
+	// the conditions of the client concern its own cache, the source image is always needed
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
 
-	// gofreq.Header.Set("User-Agent", "imgresizr "+Version)
+	if o.UserAgent != "" {
+		req.Header.Set("User-Agent", o.UserAgent)
+	}
 	req.URL = url
 	return req
 }
@@ -0,0 +1,64 @@
+package internalhttp
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadImageMaxSourceBytes(t *testing.T) {
+	t.Parallel()
+	body := bytes.Repeat([]byte{1}, 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// flushing before writing the body leaves the length unknown
+			w.(http.Flusher).Flush()
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		path     string
+		maxBytes int64
+		tooLarge bool
+	}{
+		{path: "/sized", maxBytes: 0},
+		{path: "/sized", maxBytes: 1000},
+		{path: "/sized", maxBytes: 999, tooLarge: true},
+		{path: "/chunked", maxBytes: 1000},
+		{path: "/chunked", maxBytes: 999, tooLarge: true},
+	}
+
+	for _, tc := range tests {
+		o := &Server{HTTPReadTimeout: 5, MaxSourceBytes: tc.maxBytes}
+		buf, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL+tc.path, nil)
+		if tc.tooLarge {
+			require.ErrorIs(t, err, ErrSourceTooLarge, "%s with limit %d", tc.path, tc.maxBytes)
+			continue
+		}
+		require.NoError(t, err, "%s with limit %d", tc.path, tc.maxBytes)
+		require.Equal(t, body, buf)
+	}
+}
+
+func TestCheckSourcePixels(t *testing.T) {
+	t.Parallel()
+	var animated, still bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&animated, testAnimation(gif.DisposalNone)))
+	require.NoError(t, gif.Encode(&still, image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9), nil))
+
+	o := &Server{MaxSourcePixels: 20}
+	require.NoError(t, o.checkSourcePixels(still.Bytes(), "still.gif"))
+	// three frames of 4x4 are decoded
+	require.ErrorIs(t, o.checkSourcePixels(animated.Bytes(), "animated.gif"), ErrSourceTooManyPixels)
+	o.MaxSourcePixels = 48
+	require.NoError(t, o.checkSourcePixels(animated.Bytes(), "animated.gif"))
+}
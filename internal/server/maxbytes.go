@@ -0,0 +1,77 @@
+package internalhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+)
+
+const (
+	HeaderImageQuality = "X-Image-Quality"
+
+	minSearchQuality = 5
+	maxSearchQuality = 95
+)
+
+var ErrMaxBytesUnreachable = errors.New("image can't be encoded within the requested size")
+
+// ResizeToMaxBytes resizes the image and searches for the highest quality which keeps the
+// encoded result within opts.MaxBytes. It returns the result and the quality chosen.
+// The result is a JPEG image unless WebP was requested, transparency is flattened for JPEG.
+func ResizeToMaxBytes(image []byte, opts Options) (buf []byte, quality int, err error) {
+	defer recoverLibvips(&buf, &err)
+
+	format := JPEG
+	if opts.Format == WEBP {
+		format = WEBP
+	}
+
+	// resize once to a lossless image and encode only that during the search
+	lossless := opts
+	lossless.Format, lossless.Quality, lossless.Palette, lossless.MaxBytes = PNG, 0, 0, 0
+	buf, err = Resize(image, lossless)
+	if err != nil {
+		return []byte{}, 0, err
+	}
+	decoded, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return []byte{}, 0, fmt.Errorf("unable to decode resized image: %w", err)
+	}
+	img := toNRGBA(decoded)
+
+	var best []byte
+	smallest := 0
+	lo, hi := minSearchQuality, maxSearchQuality
+	for lo <= hi {
+		q := (lo + hi) / 2
+		candidate, err := encodeImage(img, format, Options{Quality: q})
+		if err != nil {
+			return []byte{}, 0, err
+		}
+		if len(candidate) <= opts.MaxBytes {
+			best, quality = candidate, q
+			lo = q + 1
+			continue
+		}
+		smallest = len(candidate)
+		hi = q - 1
+	}
+
+	if best == nil {
+		return []byte{}, 0, fmt.Errorf("%w: (maxbytes=%d) (size at quality %d=%d)",
+			ErrMaxBytesUnreachable, opts.MaxBytes, minSearchQuality, smallest)
+	}
+	return best, quality, nil
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba
+	}
+	out := image.NewNRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
@@ -0,0 +1,185 @@
+package internalhttp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"sort"
+)
+
+const (
+	minPaletteColors = 2
+	maxPaletteColors = 256
+)
+
+// histogramEntry accumulates the pixels falling into one histogram cell.
+type histogramEntry struct {
+	r, g, b, a uint64
+	count      uint64
+}
+
+func (e histogramEntry) channel(i int) uint64 {
+	switch i {
+	case 0:
+		return e.r / e.count
+	case 1:
+		return e.g / e.count
+	default:
+		return e.b / e.count
+	}
+}
+
+// colorBox is a set of histogram cells which becomes one palette color.
+type colorBox []histogramEntry
+
+// widestChannel returns the color channel with the widest range of values in the box and that range.
+func (b colorBox) widestChannel() (int, uint64) {
+	channel, widest := 0, uint64(0)
+	for i := 0; i < 3; i++ {
+		lo, hi := uint64(255), uint64(0)
+		for _, e := range b {
+			v := e.channel(i)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi > lo && hi-lo > widest {
+			channel, widest = i, hi-lo
+		}
+	}
+	return channel, widest
+}
+
+// split divides the box at the weighted median of its widest channel.
+func (b colorBox) split() (colorBox, colorBox) {
+	channel, _ := b.widestChannel()
+	sort.Slice(b, func(i, j int) bool { return b[i].channel(channel) < b[j].channel(channel) })
+
+	var total, sum uint64
+	for _, e := range b {
+		total += e.count
+	}
+	for i, e := range b[:len(b)-1] {
+		sum += e.count
+		if sum*2 >= total {
+			return b[:i+1], b[i+1:]
+		}
+	}
+	return b[:len(b)-1], b[len(b)-1:]
+}
+
+func (b colorBox) average() color.NRGBA {
+	var sum histogramEntry
+	for _, e := range b {
+		sum.r, sum.g, sum.b, sum.a = sum.r+e.r, sum.g+e.g, sum.b+e.b, sum.a+e.a
+		sum.count += e.count
+	}
+	return color.NRGBA{
+		R: uint8(sum.r / sum.count), G: uint8(sum.g / sum.count),
+		B: uint8(sum.b / sum.count), A: uint8(sum.a / sum.count),
+	}
+}
+
+// quantize reduces the image to a palette of at most n colors using the median cut algorithm.
+// Fully transparent pixels get a palette entry of their own.
+func quantize(img image.Image, n int, dither bool) *image.Paletted {
+	bounds := img.Bounds()
+	cells := make(map[uint32]*histogramEntry)
+	transparent := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c, _ := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				transparent = true
+				continue
+			}
+			// 5 bits per color and 4 bits of alpha are enough to tell the colors apart
+			key := uint32(c.R>>3)<<15 | uint32(c.G>>3)<<10 | uint32(c.B>>3)<<5 | uint32(c.A>>4)
+			e, ok := cells[key]
+			if !ok {
+				e = &histogramEntry{}
+				cells[key] = e
+			}
+			e.r, e.g, e.b, e.a = e.r+uint64(c.R), e.g+uint64(c.G), e.b+uint64(c.B), e.a+uint64(c.A)
+			e.count++
+		}
+	}
+
+	if transparent {
+		n--
+	}
+	boxes := []colorBox{make(colorBox, 0, len(cells))}
+	for _, e := range cells {
+		boxes[0] = append(boxes[0], *e)
+	}
+	for len(boxes) < n {
+		// split the box with the widest range of colors
+		widest, index := uint64(0), -1
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			if _, w := b.widestChannel(); w > widest || index < 0 {
+				widest, index = w, i
+			}
+		}
+		if index < 0 {
+			break
+		}
+		first, second := boxes[index].split()
+		boxes[index] = first
+		boxes = append(boxes, second)
+	}
+
+	palette := make(color.Palette, 0, len(boxes)+1)
+	if transparent {
+		palette = append(palette, color.NRGBA{})
+	}
+	for _, b := range boxes {
+		if len(b) > 0 {
+			palette = append(palette, b.average())
+		}
+	}
+	if len(palette) == 0 {
+		palette = append(palette, color.NRGBA{})
+	}
+
+	out := image.NewPaletted(bounds, palette)
+	if dither {
+		draw.FloydSteinberg.Draw(out, bounds, img, bounds.Min)
+	} else {
+		draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	}
+	return out
+}
+
+// paletteFormat returns the output format for a quantized image, indexed PNG unless GIF was requested.
+func paletteFormat(format ImageType) ImageType {
+	if format == GIF {
+		return GIF
+	}
+	return PNG
+}
+
+// encodePaletted writes the quantized image as GIF or indexed PNG.
+func encodePaletted(img *image.Paletted, format ImageType) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == GIF {
+		err = gif.Encode(&buf, img, &gif.Options{NumColors: len(img.Palette)})
+	} else {
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode quantized image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,66 @@
+package internalhttp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gradient returns an image with a lot of distinct colors and a transparent first row.
+func gradient() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 1; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func TestQuantize(t *testing.T) {
+	t.Parallel()
+	for _, n := range []int{2, 16, 256} {
+		for _, dither := range []bool{false, true} {
+			out := quantize(gradient(), n, dither)
+			require.LessOrEqual(t, len(out.Palette), n)
+			require.Equal(t, image.Rect(0, 0, 64, 64), out.Bounds())
+
+			_, _, _, a := out.At(10, 0).RGBA()
+			require.Zero(t, a, "transparent pixels should stay transparent")
+			_, _, _, a = out.At(10, 10).RGBA()
+			require.Equal(t, uint32(0xffff), a, "opaque pixels should stay opaque")
+		}
+	}
+
+	out := quantize(gradient(), 256, false)
+	require.Greater(t, len(out.Palette), 128, "gradient should use most of the palette")
+}
+
+func TestEncodePaletted(t *testing.T) {
+	t.Parallel()
+	img := quantize(gradient(), 8, true)
+
+	buf, err := encodePaletted(img, PNG)
+	require.NoError(t, err)
+	decoded, err := png.Decode(bytes.NewReader(buf))
+	require.NoError(t, err)
+	_, indexed := decoded.(*image.Paletted)
+	require.True(t, indexed, "png should be written with a palette")
+
+	buf, err = encodePaletted(img, GIF)
+	require.NoError(t, err)
+	_, err = gif.Decode(bytes.NewReader(buf))
+	require.NoError(t, err)
+}
+
+func TestPaletteFormat(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, GIF, effectsFormat(Options{Palette: 16, Format: GIF}, JPEG))
+	require.Equal(t, PNG, effectsFormat(Options{Palette: 16}, JPEG))
+	require.Equal(t, PNG, effectsFormat(Options{Palette: 16, Format: WEBP}, JPEG))
+}
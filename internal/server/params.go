@@ -0,0 +1,221 @@
+package internalhttp
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var formatsByName = map[string]ImageType{
+	"jpeg": JPEG,
+	"jpg":  JPEG,
+	"png":  PNG,
+	"webp": WEBP,
+	"gif":  GIF,
+}
+
+// parseQueryOptions fills opts with the optional parameters passed in the query string.
+func parseQueryOptions(q url.Values, opts *Options) error {
+	var err error
+
+	if v := q.Get("frame"); v != "" {
+		opts.Frame, err = strconv.Atoi(v)
+		if err != nil || opts.Frame < 1 {
+			return fmt.Errorf("invalid frame provided: (frame=%s)", v)
+		}
+	}
+
+	if v := q.Get("page"); v != "" {
+		opts.Page, err = strconv.Atoi(v)
+		if err != nil || opts.Page < 1 {
+			return fmt.Errorf("invalid page provided: (page=%s)", v)
+		}
+	}
+
+	if v := q.Get("dpr"); v != "" {
+		opts.DPR, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(opts.DPR) || opts.DPR <= 0 || math.IsInf(opts.DPR, 0) {
+			return fmt.Errorf("invalid dpr provided: (dpr=%s)", v)
+		}
+	}
+
+	if v := q.Get("extract"); v != "" {
+		opts.Extract, err = parseRegion(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = parseEffects(q, opts)
+	if err != nil {
+		return err
+	}
+
+	err = parseText(q, opts)
+	if err != nil {
+		return err
+	}
+
+	if v := q.Get("palette"); v != "" {
+		opts.Palette, err = strconv.Atoi(v)
+		if err != nil || opts.Palette < minPaletteColors || opts.Palette > maxPaletteColors {
+			return fmt.Errorf("invalid palette provided, should be from %d to %d colors: (palette=%s)",
+				minPaletteColors, maxPaletteColors, v)
+		}
+		opts.Dither = q.Get("dither") == "1" || q.Get("dither") == "true"
+	}
+
+	if v := q.Get("maxbytes"); v != "" {
+		opts.MaxBytes, err = strconv.Atoi(v)
+		if err != nil || opts.MaxBytes < 1 {
+			return fmt.Errorf("invalid maxbytes provided: (maxbytes=%s)", v)
+		}
+	}
+
+	if v := q.Get("format"); v != "" {
+		format, ok := formatsByName[strings.ToLower(v)]
+		if !ok {
+			return fmt.Errorf("unsupported output format: (format=%s)", v)
+		}
+		opts.Format = format
+	}
+
+	return nil
+}
+
+// cacheKey returns the part of the converted image cache key describing the requested processing.
+func (opts Options) cacheKey() string {
+	key := fmt.Sprintf("%s/%dx%d", opts.Operation, opts.Width, opts.Height)
+	if opts.NoTrim {
+		key += "/notrim"
+	}
+	if opts.Operation == carveOperation {
+		key += fmt.Sprintf("/maxpixels%d", opts.CarveMaxPixels)
+	}
+	if opts.Gravity != GravityCentre {
+		key += fmt.Sprintf("/gravity%d", opts.Gravity)
+	}
+	if opts.Frame > 0 {
+		key += fmt.Sprintf("/frame%d", opts.Frame)
+	}
+	if opts.Page > 0 {
+		key += fmt.Sprintf("/page%d", opts.Page)
+	}
+	if opts.Extract.isSet() {
+		key += "/extract:" + opts.Extract.String()
+	}
+	if opts.Mask != "" {
+		key += fmt.Sprintf("/mask:%s:%d", opts.Mask, opts.Radius)
+	}
+	if opts.Border > 0 {
+		key += fmt.Sprintf("/border%d:%s", opts.Border, formatColor(opts.BorderColor))
+	}
+	if opts.Padding > 0 {
+		key += fmt.Sprintf("/pad%d:%s", opts.Padding, formatColor(opts.Background))
+	}
+	if opts.Text.isSet() {
+		key += "/text:" + url.QueryEscape(opts.Text.String())
+	}
+	if opts.Palette > 0 {
+		key += fmt.Sprintf("/palette%d:%t", opts.Palette, opts.Dither)
+	}
+	if opts.MaxBytes > 0 {
+		key += fmt.Sprintf("/maxbytes%d", opts.MaxBytes)
+	}
+	if opts.Rotate > 0 {
+		key += fmt.Sprintf("/rotate%d", opts.Rotate)
+	}
+	if opts.Mirror {
+		key += "/mirror"
+	}
+	if opts.Grayscale {
+		key += "/gray"
+	}
+	if opts.Quality > 0 {
+		key += fmt.Sprintf("/q%d", opts.Quality)
+	}
+	if opts.Format != UNKNOWN {
+		key += "/" + ImageTypes[opts.Format]
+	}
+	return key
+}
+
+// parseEffects fills opts with the mask, border and padding parameters.
+func parseEffects(q url.Values, opts *Options) error {
+	var err error
+
+	if v := q.Get("mask"); v != "" {
+		if v != MaskCircle && v != MaskRounded {
+			return fmt.Errorf("unsupported mask: (mask=%s)", v)
+		}
+		opts.Mask = v
+	}
+
+	for name, value := range map[string]*int{"radius": &opts.Radius, "border": &opts.Border, "pad": &opts.Padding} {
+		if v := q.Get(name); v != "" {
+			*value, err = strconv.Atoi(v)
+			if err != nil || *value < 0 || *value > maxEffectSize {
+				return fmt.Errorf("invalid %s provided, should be from 0 to %d: (%s=%s)", name, maxEffectSize, name, v)
+			}
+		}
+	}
+
+	if opts.Border > 0 {
+		opts.BorderColor = colorBlack
+	}
+	for name, value := range map[string]*color.NRGBA{"bordercolor": &opts.BorderColor, "bg": &opts.Background} {
+		if v := q.Get(name); v != "" {
+			*value, err = parseColor(v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseText fills opts with the text overlay parameters.
+func parseText(q url.Values, opts *Options) error {
+	var err error
+
+	opts.Text.Content = q.Get("text")
+	if !opts.Text.isSet() {
+		return nil
+	}
+
+	opts.Text.FontName = q.Get("font")
+	opts.Text.Size = defaultFontSize
+	if v := q.Get("fontsize"); v != "" {
+		opts.Text.Size, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(opts.Text.Size) || opts.Text.Size <= 0 || opts.Text.Size > maxFontSize {
+			return fmt.Errorf("invalid fontsize provided, should be up to %d: (fontsize=%s)", maxFontSize, v)
+		}
+	}
+
+	opts.Text.Color = colorBlack
+	if v := q.Get("textcolor"); v != "" {
+		opts.Text.Color, err = parseColor(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.Text.Position = defaultTextPosition
+	if v := q.Get("textpos"); v != "" {
+		if !textPositions[v] {
+			return fmt.Errorf("unsupported text position: (textpos=%s)", v)
+		}
+		opts.Text.Position = v
+	}
+
+	if v := q.Get("textwidth"); v != "" {
+		opts.Text.Width, err = strconv.Atoi(v)
+		if err != nil || opts.Text.Width < 0 {
+			return fmt.Errorf("invalid textwidth provided: (textwidth=%s)", v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package internalhttp
+
+import (
+	"image/color"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryOptions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		query   string
+		want    Options
+		invalid bool
+	}{
+		{query: "", want: Options{}},
+		{query: "frame=2", want: Options{Frame: 2}},
+		{query: "frame=0", invalid: true},
+		{query: "frame=x", invalid: true},
+		{query: "page=3", want: Options{Page: 3}},
+		{query: "page=-1", invalid: true},
+		{query: "format=WEBP", want: Options{Format: WEBP}},
+		{query: "format=jpg", want: Options{Format: JPEG}},
+		{query: "format=bmp", invalid: true},
+		{query: "dpr=1.5", want: Options{DPR: 1.5}},
+		{query: "dpr=0", invalid: true},
+		{query: "dpr=NaN", invalid: true},
+		{query: "dpr=Inf", invalid: true},
+		{query: "mask=circle&border=2", want: Options{Mask: MaskCircle, Border: 2, BorderColor: colorBlack}},
+		{
+			query: "mask=rounded&radius=8&pad=4&bg=ffffff80",
+			want:  Options{Mask: MaskRounded, Radius: 8, Padding: 4, Background: color.NRGBA{255, 255, 255, 128}},
+		},
+		{query: "mask=star", invalid: true},
+		{query: "border=-1", invalid: true},
+		{query: "border=1001", invalid: true},
+		{query: "pad=100000", invalid: true},
+		{query: "radius=1001", invalid: true},
+		{query: "bordercolor=12345", invalid: true},
+		{query: "palette=16&dither=1", want: Options{Palette: 16, Dither: true}},
+		{query: "palette=1", invalid: true},
+		{query: "palette=257", invalid: true},
+		{query: "maxbytes=30000", want: Options{MaxBytes: 30000}},
+		{query: "maxbytes=0", invalid: true},
+		{query: "text=a&fontsize=NaN", invalid: true},
+		{query: "text=a&fontsize=1001", invalid: true},
+		{query: "text=a&fontsize=Inf", invalid: true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.query, func(t *testing.T) {
+			t.Parallel()
+			q, err := url.ParseQuery(tc.query)
+			require.NoError(t, err)
+
+			var opts Options
+			err = parseQueryOptions(q, &opts)
+			if tc.invalid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, opts)
+		})
+	}
+}
+
+func TestOptionsCacheKey(t *testing.T) {
+	t.Parallel()
+	opts := Options{Operation: "fill", Width: 100, Height: 50}
+	require.Equal(t, "fill/100x50", opts.cacheKey())
+
+	opts.Page, opts.Format = 2, PNG
+	require.Equal(t, "fill/100x50/page2/png", opts.cacheKey())
+
+	opts.Operation = "resize"
+	require.NotEqual(t, "fill/100x50/page2/png", opts.cacheKey())
+}
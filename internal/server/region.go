@@ -0,0 +1,84 @@
+package internalhttp
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const regionPercentPrefix = "pct:"
+
+var ErrRegionOutOfBounds = errors.New("extract area is out of the image bounds")
+
+// Region is a rectangle cut out of the source image before it is resized.
+// The values are pixels or, if Percent is set, percents of the source dimensions.
+type Region struct {
+	Left, Top, Width, Height float64
+	Percent                  bool
+}
+
+// parseRegion parses a region written as "left,top,width,height" or "pct:left,top,width,height".
+func parseRegion(value string) (Region, error) {
+	var r Region
+	v := value
+	if strings.HasPrefix(v, regionPercentPrefix) {
+		r.Percent = true
+		v = strings.TrimPrefix(v, regionPercentPrefix)
+	}
+
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return Region{}, fmt.Errorf("invalid extract area provided: (extract=%s)", value)
+	}
+
+	values := make([]float64, 0, len(parts))
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) || (!r.Percent && f != math.Trunc(f)) {
+			return Region{}, fmt.Errorf("invalid extract area provided: (extract=%s)", value)
+		}
+		values = append(values, f)
+	}
+	r.Left, r.Top, r.Width, r.Height = values[0], values[1], values[2], values[3]
+
+	if r.Width == 0 || r.Height == 0 || (r.Percent && (r.Left+r.Width > 100 || r.Top+r.Height > 100)) {
+		return Region{}, fmt.Errorf("invalid extract area provided: (extract=%s)", value)
+	}
+	return r, nil
+}
+
+func (r Region) isSet() bool {
+	return r.Width > 0 && r.Height > 0
+}
+
+func (r Region) String() string {
+	s := strings.Join([]string{
+		strconv.FormatFloat(r.Left, 'f', -1, 64), strconv.FormatFloat(r.Top, 'f', -1, 64),
+		strconv.FormatFloat(r.Width, 'f', -1, 64), strconv.FormatFloat(r.Height, 'f', -1, 64),
+	}, ",")
+	if r.Percent {
+		return regionPercentPrefix + s
+	}
+	return s
+}
+
+// rect resolves the region against the source dimensions and checks it fits inside them.
+func (r Region) rect(width, height int) (image.Rectangle, error) {
+	left, top, w, h := r.Left, r.Top, r.Width, r.Height
+	if r.Percent {
+		left = left * float64(width) / 100
+		top = top * float64(height) / 100
+		w = w * float64(width) / 100
+		h = h * float64(height) / 100
+	}
+
+	rect := image.Rect(int(math.Round(left)), int(math.Round(top)),
+		int(math.Round(left+w)), int(math.Round(top+h)))
+	if rect.Empty() || !rect.In(image.Rect(0, 0, width, height)) {
+		return image.Rectangle{}, fmt.Errorf("%w: (extract=%s) (image=%dx%d)", ErrRegionOutOfBounds, r, width, height)
+	}
+	return rect, nil
+}
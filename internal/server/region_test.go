@@ -0,0 +1,57 @@
+package internalhttp
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRegion(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		value   string
+		want    Region
+		invalid bool
+	}{
+		{value: "10,20,30,40", want: Region{Left: 10, Top: 20, Width: 30, Height: 40}},
+		{value: "pct:10,20,30.5,40", want: Region{Left: 10, Top: 20, Width: 30.5, Height: 40, Percent: true}},
+		{value: "10,20,30", invalid: true},
+		{value: "10,20,0,40", invalid: true},
+		{value: "-1,20,30,40", invalid: true},
+		{value: "1.5,20,30,40", invalid: true},
+		{value: "pct:50,0,60,10", invalid: true},
+		{value: "a,b,c,d", invalid: true},
+		{value: "pct:NaN,0,50,50", invalid: true},
+		{value: "0,0,Inf,50", invalid: true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.value, func(t *testing.T) {
+			t.Parallel()
+			r, err := parseRegion(tc.value)
+			if tc.invalid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, r)
+			require.Equal(t, tc.value, r.String())
+		})
+	}
+}
+
+func TestRegionRect(t *testing.T) {
+	t.Parallel()
+	rect, err := Region{Left: 10, Top: 20, Width: 30, Height: 40}.rect(100, 100)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(10, 20, 40, 60), rect)
+
+	rect, err = Region{Left: 50, Top: 25, Width: 50, Height: 50, Percent: true}.rect(200, 100)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(100, 25, 200, 75), rect)
+
+	_, err = Region{Left: 80, Top: 0, Width: 30, Height: 10}.rect(100, 100)
+	require.ErrorIs(t, err, ErrRegionOutOfBounds)
+}
@@ -2,50 +2,172 @@ package internalhttp
 
 import (
 	"errors"
-
-	"github.com/h2non/bimg"
+	"fmt"
+	"image"
+	"image/color"
 )
 
+// ErrOutOfRange is returned for a frame or a page the source image does not have.
+var ErrOutOfRange = errors.New("requested frame or page is out of range")
+
 type Options struct {
-	Width, Height int
-	Force         bool
-	Operation     string
+	Width, Height  int
+	Force          bool
+	NoTrim         bool // keep uniform borders of the source, needed when the geometry has to be exact
+	Operation      string
+	Gravity        Gravity // part of the source kept when cropping, the centre by default
+	Frame          int     // 1-based frame to extract from animated image, 0 keeps the animation
+	Page           int     // 1-based page of a PDF document to render, 0 renders the first one
+	DPR            float64 // device pixel ratio the dimensions are multiplied by
+	Quality        int     // output quality, 0 uses the encoder default
+	Extract        Region  // area of the source to cut out before resizing
+	Mask           string  // shape to cut the result to: circle or rounded
+	Radius         int     // corner radius of the rounded mask
+	Border         int     // border width around the result
+	BorderColor    color.NRGBA
+	Padding        int // padding between the result and the border
+	Background     color.NRGBA
+	Text           Text      // caption rendered onto the result
+	Palette        int       // number of colors to quantize the result to, written as indexed PNG or GIF
+	Dither         bool      // dither the quantized result
+	MaxBytes       int       // size limit of the result, the quality is searched to fit into it
+	Rotate         int       // clockwise rotation in degrees, a multiple of 90, applied before resizing
+	Mirror         bool      // mirror the source horizontally before rotating it
+	Grayscale      bool      // convert the result to shades of gray
+	CarveMaxPixels int       // limit of the pixels the carve operation works on, set by the server
+	Format         ImageType // output format, UNKNOWN keeps the source format
+
+	VectorMaxPixels int64 // limit of the pixels a vector source is rendered to, set by the server
 }
 
 func Resize(image []byte, opts Options) (buf []byte, err error) {
 	// opts.Force = true
-	defer func() {
-		if r := recover(); r != nil {
-			switch value := r.(type) {
-			case error:
-				err = value
-			case string:
-				err = errors.New(value)
-			default:
-				err = errors.New("libvips internal error")
-			}
-			buf = []byte{}
-		}
-	}()
-
-	params := bimg.Options{
-		Enlarge: true,
-		Trim:    true,
-		Width:   opts.Width,
-		Height:  opts.Height,
-		Force:   opts.Force,
-		Crop:    opts.Operation == "fill",
-	}
-
-	return bimg.Resize(image, params)
+	defer recoverLibvips(&buf, &err)
+
+	if opts.MaxBytes > 0 {
+		buf, _, err = ResizeToMaxBytes(image, opts)
+		return buf, err
+	}
+
+	if imageType := DetermineImageType(image); isVector(imageType) {
+		image, err = processingEngine().Rasterize(image, imageType, opts)
+		if err != nil {
+			return []byte{}, err
+		}
+	}
+
+	if anim := decodeAnimation(image); anim != nil {
+		if keepsAnimation(opts) {
+			return resizeAnimated(anim, opts)
+		}
+		if opts.Frame == 0 {
+			opts.Frame = 1
+		}
+		image, err = extractFrame(anim, opts.Frame)
+		if err != nil {
+			return []byte{}, err
+		}
+	} else if opts.Frame > 1 {
+		return []byte{}, fmt.Errorf("%w: (frame=%d) (frames=1)", ErrOutOfRange, opts.Frame)
+	}
+
+	params := engineOptions(opts)
+	if opts.Extract.isSet() {
+		// the area is cut out by the resize itself rather than encoded on its own first
+		params.Extract, err = extractArea(image, opts.Extract)
+		if err != nil {
+			return []byte{}, err
+		}
+	}
+
+	if opts.Operation == carveOperation {
+		if opts.Format == UNKNOWN {
+			// the carved image is a PNG, the result keeps the format of the source
+			opts.Format = DetermineImageType(image)
+		}
+		image, err = carveImage(image, opts, params.Extract)
+		if err != nil {
+			return []byte{}, err
+		}
+		// the carved image has the requested size, trimming it would change that
+		opts.NoTrim = true
+		params = engineOptions(opts)
+	}
+
+	if !opts.hasEffects() {
+		return processingEngine().Resize(image, params)
+	}
+
+	format := effectsFormat(opts, DetermineImageType(image))
+	params.Type = PNG
+	image, err = processingEngine().Resize(image, params)
+	if err != nil {
+		return []byte{}, err
+	}
+	result, err := applyEffects(image, opts)
+	if err != nil {
+		return []byte{}, err
+	}
+	return encodeImage(result, format, opts)
 }
 
-func GetImageMimeType(code bimg.ImageType) string {
-	if code == bimg.PNG {
+// extractArea resolves the region against the size of the image and validates it.
+func extractArea(buf []byte, region Region) (image.Rectangle, error) {
+	size, err := processingEngine().Size(buf)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return region.rect(size.Width, size.Height)
+}
+
+// recoverLibvips turns a panic during processing into an error, it has to be deferred.
+func recoverLibvips(buf *[]byte, err *error) {
+	if r := recover(); r != nil {
+		switch value := r.(type) {
+		case error:
+			*err = value
+		case string:
+			*err = errors.New(value)
+		default:
+			*err = errors.New("libvips internal error")
+		}
+		*buf = []byte{}
+	}
+}
+
+func engineOptions(opts Options) EngineOptions {
+	params := EngineOptions{
+		Enlarge:   true,
+		Trim:      !opts.NoTrim,
+		Width:     opts.Width,
+		Height:    opts.Height,
+		Force:     opts.Force,
+		Crop:      opts.Operation == "fill",
+		Gravity:   opts.Gravity,
+		Type:      opts.Format,
+		Quality:   opts.Quality,
+		Rotate:    opts.Rotate,
+		Grayscale: opts.Grayscale,
+	}
+	// engines flip after rotating, mirroring before a quarter turn is a vertical flip after it
+	if opts.Mirror && opts.Rotate%180 == 0 {
+		params.Flip = true
+	}
+	if opts.Mirror && opts.Rotate%180 != 0 {
+		params.Flop = true
+	}
+	return params
+}
+
+func GetImageMimeType(code ImageType) string {
+	if code == PNG {
 		return "image/png"
 	}
-	if code == bimg.WEBP {
+	if code == WEBP {
 		return "image/webp"
 	}
+	if code == GIF {
+		return "image/gif"
+	}
 	return "image/jpeg"
 }
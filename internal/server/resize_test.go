@@ -8,7 +8,6 @@ import (
 	"testing"
 
 	"github.com/Dmit1812/imgresizr/internal/utilities"
-	"github.com/h2non/bimg"
 	"github.com/stretchr/testify/require"
 	"github.com/vitali-fedulov/images4"
 )
@@ -43,16 +42,15 @@ func TestResize(t *testing.T) {
 	require.NoErrorf(t, err, "image %s should be loaded from paths %v, but it couldn't", imagename, paths)
 	originalDir := filepath.Dir(originalFile)
 
-	// create a bimg object and get size of the original image
-	originalImageB := bimg.NewImage(originalImage)
-	originalSize, _ := originalImageB.Size()
+	// get size of the original image
+	originalSize, _ := processingEngine().Size(originalImage)
 
 	// for every size we would like to test run image resizing
 	for _, tc := range tests {
 		tc := tc
 		t.Run(fmt.Sprintf("%dx%d", tc.width, tc.height), func(t *testing.T) {
 			t.Parallel()
-			params := bimg.Options{
+			params := EngineOptions{
 				Enlarge: true,
 				Trim:    true,
 				Width:   tc.width,
@@ -62,13 +60,12 @@ func TestResize(t *testing.T) {
 			}
 
 			// do a resized image []b
-			newImage, err := bimg.Resize(originalImage, params)
+			newImage, err := processingEngine().Resize(originalImage, params)
 			require.NoErrorf(t, err, "image %s %dx%d should be resized to %dx%d, but it couldn't",
 				imagename, originalSize.Width, originalSize.Height, tc.width, tc.height)
 
 			// we are not going to look into actual image we will compare the resulting size
-			newImageB := bimg.NewImage(newImage)
-			newSize, err := newImageB.Size()
+			newSize, err := processingEngine().Size(newImage)
 			require.NoError(t, err, "new image should have size extracted without error")
 
 			// compare that new image has correct size
@@ -106,3 +103,26 @@ func TestResize(t *testing.T) {
 		})
 	}
 }
+
+// verify the quality search keeps the result within the limit and lower limits give lower quality.
+func TestResizeToMaxBytes(t *testing.T) {
+	t.Parallel()
+	originalImage, _, err := utilities.LoadImage("", imagename, paths)
+	require.NoError(t, err)
+
+	opts := Options{Width: 300, Height: 200, Operation: "fill"}
+	previous := maxSearchQuality + 1
+	for _, limit := range []int{30000, 10000, 5000} {
+		opts.MaxBytes = limit
+		buf, quality, err := ResizeToMaxBytes(originalImage, opts)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(buf), limit)
+		require.LessOrEqual(t, quality, previous)
+		require.Equal(t, JPEG, DetermineImageType(buf))
+		previous = quality
+	}
+
+	opts.MaxBytes = 10
+	_, _, err = ResizeToMaxBytes(originalImage, opts)
+	require.ErrorIs(t, err, ErrMaxBytesUnreachable)
+}
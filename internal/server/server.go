@@ -13,7 +13,9 @@ import (
 	"time"
 
 	"github.com/Dmit1812/imgresizr/internal/lrufilecache"
-	"github.com/h2non/bimg"
+	"github.com/Dmit1812/imgresizr/pkg/breaker"
+	"github.com/Dmit1812/imgresizr/pkg/flight"
+	"github.com/Dmit1812/imgresizr/pkg/workpool"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -31,7 +33,50 @@ type Server struct {
 	Log                 Logger
 	BaseImageCache      Cache
 	ConvertedImageCache Cache
+	TileCache           Cache // deep zoom tiles, the converted image cache is used if nil
 	ErrorImage          []byte
+	ErrorImages         map[string][]byte // error images by error class, ErrorImage is used for the others
+	NoErrorImage        bool              // errors are answered with the message as text, also if ErrorImage is empty
+	AllowSVG            bool
+	AllowPDF            bool
+	ClientHints         bool
+	MaxDPR              float64
+	SaveDataQuality     int
+	FontPath            string
+	Thumbor             bool         // accept URLs in the thumbor dialect
+	ThumborKey          string       // key thumbor URLs are signed with, unsafe URLs are accepted if empty
+	CarveMaxPixels      int          // limit of the pixels seam carving works on, a default is used if 0
+	MaxSourceBytes      int64        // limit of the downloaded source size, unlimited if 0
+	MaxSourcePixels     int64        // limit of the decoded source pixels, unlimited if 0
+	MaxWidth            int          // limit of the output width, unlimited if 0
+	MaxHeight           int          // limit of the output height, unlimited if 0
+	MaxArea             int64        // limit of the output width times height, unlimited if 0
+	FetchTimeout        int          // seconds the source download may take, HTTPReadTimeout is used if 0
+	ProcessTimeout      int          // seconds the conversion may take, unlimited if 0
+	SendTimeout         int          // seconds writing the converted image may take, unlimited if 0
+	Workers             int          // limit of the conversions running at once, unlimited if 0
+	QueueSize           int          // limit of the conversions waiting for a worker
+	QueueTimeout        int          // seconds a conversion may wait for a worker, unlimited if 0
+	PrioritizeSmall     bool         // conversions producing fewer pixels skip ahead in the queue
+	RetryAfter          int          // seconds clients are asked to wait when the server is busy, 1 if 0
+	Client              *http.Client // client source images are downloaded with, http.DefaultClient if nil
+	UserAgent           string       // User-Agent of the source downloads, the one of the client request if empty
+	Retries             int          // retries of source downloads failing to connect or with 502, 503 or 504
+	RetryBackoff        int          // milliseconds before the first retry, doubled with every next one
+	BreakerFailures     int          // consecutive failures opening the circuit breaker of a host, disabled if 0
+	BreakerCooldown     int          // seconds requests to a host fail fast once its breaker opened
+	MinCacheTTL         int          // seconds a cached source image is used at least before revalidation
+	MaxCacheTTL         int          // seconds a cached source image is used at most, until evicted if 0
+	StalePolicy         StalePolicy  // how long expired images are still served, per origin if listed below
+	// stale policies by source host overriding StalePolicy
+	OriginStalePolicies map[string]StalePolicy
+	fonts               sync.Map
+	fetches             flight.Group[sharedResult] // source downloads in progress
+	conversions         flight.Group[sharedResult] // conversions in progress
+	pool                *workpool.Pool
+	poolOnce            sync.Once
+	breakers            *breaker.Set
+	breakersOnce        sync.Once
 }
 
 type Logger interface {
@@ -131,7 +176,35 @@ func (o *Server) NewServerMux() http.Handler {
 	mux := httprouter.New()
 	mux.GET("/", o.indexRoute)
 	mux.GET("/:operation/:width/:height/*url", o.resizeRoute())
-	return mux
+
+	// httprouter doesn't allow static routes next to the operation parameter,
+	// the prefixed endpoints are dispatched before the router
+	iiif, dzi, thumbor, sprite := o.iiifRoute(), o.dziRoute(), o.thumborRoute(), o.spriteRoute()
+	status := o.statusRoute()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRequestID, requestID(r))
+		if strings.HasPrefix(r.URL.Path, iiifPrefix) {
+			iiif(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, dziPrefix) {
+			dzi(w, r)
+			return
+		}
+		if r.URL.Path == spritePath || r.URL.Path == spriteJSONPath {
+			sprite(w, r)
+			return
+		}
+		if r.URL.Path == statusPath {
+			status(w, r)
+			return
+		}
+		if o.Thumbor && isThumborPath(r.URL.Path) {
+			thumbor(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
 }
 
 func (o *Server) listenAndServe(s *http.Server) error {
@@ -143,81 +216,269 @@ func (o *Server) listenAndServe(s *http.Server) error {
 
 func (o *Server) resizeRoute() func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		o.advertiseClientHints(w)
+
 		if r.Method != "GET" {
 			o.Log.Error(fmt.Sprintf("unsupported method %s", r.Method))
-			o.failedRequest(w, "the method is not allowed")
+			o.failedRequest(w, r, "the method is not allowed")
 			return
 		}
 
 		width, height, err := parseDimensions(ps.ByName("width") + "x" + ps.ByName("height"))
 		if err != nil {
 			o.Log.Error("invalid width or height provided")
-			o.failedRequest(w, "invalid width or height provided")
+			o.failedRequest(w, r, "invalid width or height provided")
 			return
 		}
 
-		opts := Options{Width: width, Height: height, Operation: ps.ByName("operation")}
+		opts := Options{
+			Width: width, Height: height, Operation: ps.ByName("operation"), CarveMaxPixels: o.CarveMaxPixels,
+		}
+
+		err = parseQueryOptions(r.URL.Query(), &opts)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failed(w, r, ps.ByName("url")[1:], opts, err)
+			return
+		}
+		o.applyDeviceHints(r.Header, &opts)
+
+		opts.Text.Font, err = o.loadFont(opts.Text.FontName)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failed(w, r, ps.ByName("url")[1:], opts, err)
+			return
+		}
 
-		baseimagekey := ps.ByName("url")[1:]
-		convertedimagekey := ps.ByName("width") + "x" + ps.ByName("height") + "-" + ps.ByName("url")[1:]
 		o.Log.Info(fmt.Sprintf("will resize to %dx%d with operation %s image at %s",
-			width, height, ps.ByName("operation"), baseimagekey))
+			width, height, ps.ByName("operation"), ps.ByName("url")[1:]))
 
-		var imageResponseHeaders *http.Header
-		var cifound, bifound bool
+		o.serveImage(w, r, o.ConvertedImageCache, ps.ByName("url")[1:], opts)
+	}
+}
 
-		ci, cifound := o.ConvertedImageCache.Get(convertedimagekey)
-		image := ci.Content
-		imageResponseHeaders = &ci.Headers
+// sourceLoader returns the image the conversion of the source image at baseimagekey starts from.
+type sourceLoader func(ctx context.Context, baseimagekey string, h *http.Header) (sharedResult, error)
 
-		if !cifound {
-			ci, bifound = o.BaseImageCache.Get(baseimagekey)
-			image = ci.Content
-			imageResponseHeaders = &ci.Headers
+// serveImage writes the source image at baseimagekey converted with opts, the source image and the
+// converted one kept in the given cache are reused when possible.
+func (o *Server) serveImage(w http.ResponseWriter, r *http.Request, cache Cache, baseimagekey string, opts Options) {
+	o.serveImageFrom(w, r, cache, baseimagekey, opts, o.getBaseImage)
+}
+
+// serveImageFrom is serveImage converting the image load returns in place of the source image.
+func (o *Server) serveImageFrom(
+	w http.ResponseWriter, r *http.Request, cache Cache, baseimagekey string, opts Options, load sourceLoader,
+) {
+	var err error
+	var imageResponseHeaders *http.Header
+
+	// refuse sizes over the limits before anything is fetched
+	err = o.checkDimensions(outputSize(opts, ImageSize{}))
+	if err != nil {
+		o.Log.Error(err.Error())
+		o.failedSource(w, r, baseimagekey, err)
+		return
+	}
+
+	convertedimagekey := opts.cacheKey() + "-" + baseimagekey
+	convert := func(h *http.Header) func(ctx context.Context) (sharedResult, error) {
+		return func(ctx context.Context) (sharedResult, error) {
+			return o.convertImage(ctx, cache, convertedimagekey, baseimagekey, h, opts, load)
+		}
+	}
+	now := time.Now()
+	policy := o.stalePolicy(baseimagekey)
+	ci, cifound := cache.Get(convertedimagekey)
+	stale := cifound && ci.Expired(now)
+	if stale && policy.whileRevalidate(ci, now) {
+		// the expired converted image is served while it is made again from its revalidated source
+		o.refreshInBackground(&o.conversions, convertedimagekey, convert(cloneHeader(&r.Header)))
+		stale = false
+	}
+	cifound = cifound && !stale
+	image := ci.Content
+	imageResponseHeaders = &ci.Headers
+
+	if !cifound {
+		// identical requests arriving meanwhile wait for this conversion instead of doing their own
+		var res sharedResult
+		res, err = o.conversions.Do(r.Context(), convertedimagekey, convert(&r.Header))
+		if err != nil && stale && policy.ifError(ci, now, err) {
+			o.Log.Warn(fmt.Sprintf("serving stale image %s as its origin failed: %s", convertedimagekey, err))
+			res, err = sharedResult{image: ci.Content, headers: &ci.Headers}, nil
 		}
+		if errors.Is(err, ErrDimensionsTooLarge) {
+			o.Log.Error(err.Error())
+			o.failedSource(w, r, baseimagekey, err)
+			return
+		}
+		if errors.Is(err, ErrServerBusy) {
+			o.Log.Warn(err.Error())
+			o.busy(w, r, err.Error())
+			return
+		}
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failed(w, r, baseimagekey, opts, err)
+			return
+		}
+		image, imageResponseHeaders = res.image, res.headers
+	}
 
-		if !cifound && !bifound {
-			image, imageResponseHeaders, err = o.LoadImageFromNetwork(baseimagekey, &r.Header)
-			if err != nil {
-				o.Log.Error(err.Error())
-				o.failed(w, opts, err.Error())
-				return
-			}
+	writeHeaders(imageResponseHeaders, w)
 
-			if !imageOK(image) {
-				err = fmt.Errorf("invalid image at URL: (url=%s)", baseimagekey)
-				o.Log.Error(err.Error())
-				o.failed(w, opts, err.Error())
-				return
-			}
+	mime := GetImageMimeType(DetermineImageType(image))
+	w.Header().Set("Content-Type", mime)
+	o.startSending(w)
+	w.Write(image)
+}
+
+// convertImage converts the image load returns for the source image at baseimagekey with opts
+// and puts the result into the cache.
+func (o *Server) convertImage(ctx context.Context, cache Cache, convertedimagekey, baseimagekey string,
+	h *http.Header, opts Options, load sourceLoader,
+) (sharedResult, error) {
+	base, err := load(ctx, baseimagekey, h)
+	image, headers := base.image, base.headers
+	if err != nil {
+		return sharedResult{headers: headers}, err
+	}
 
-			o.BaseImageCache.Set(baseimagekey, lrufilecache.CacheItem{
-				Content: image,
-				Headers: cleanHeaders(imageResponseHeaders),
-			})
-			o.Log.Debug("Loaded base image " + baseimagekey + " from server and saved it to cache")
+	// a converted image made from the same version of the source, e.g. one the source server
+	// answered is not modified, is kept with the refreshed headers and expiry of the source
+	if ci, found := cache.Get(convertedimagekey); found && headers != nil && sameSource(ci.Headers, *headers) {
+		refreshed := cleanHeaders(headers)
+		if quality := ci.Headers.Get(HeaderImageQuality); quality != "" {
+			refreshed.Set(HeaderImageQuality, quality)
 		}
+		ci = lrufilecache.CacheItem{Content: ci.Content, Headers: refreshed, Expires: base.expires}
+		cache.Set(convertedimagekey, ci)
+		o.Log.Debug("Revalidated converted image " + convertedimagekey + " with its source")
+		return sharedResult{image: ci.Content, headers: &ci.Headers, expires: ci.Expires}, nil
+	}
 
-		if !cifound {
-			image, err = Resize(image, opts)
-			if err != nil {
-				o.Log.Error(err.Error())
-				o.failed(w, opts, err.Error())
-				return
-			}
+	err = o.checkOutputSize(opts, image)
+	if err != nil {
+		return sharedResult{headers: headers}, err
+	}
+
+	convertedHeaders := cleanHeaders(headers)
+	source := image
+	opts.VectorMaxPixels = o.vectorMaxPixels()
+	image, err = o.process(ctx, conversionCost(opts, source), func() ([]byte, error) {
+		if opts.MaxBytes > 0 {
+			buf, quality, err := ResizeToMaxBytes(source, opts)
+			// the chosen quality is cached along with the image
+			convertedHeaders.Set(HeaderImageQuality, strconv.Itoa(quality))
+			return buf, err
+		}
+		return Resize(source, opts)
+	})
+	if err != nil {
+		return sharedResult{headers: headers}, err
+	}
+
+	// the converted image expires along with its source
+	cache.Set(convertedimagekey, lrufilecache.CacheItem{
+		Content: image, Headers: convertedHeaders, Expires: base.expires,
+	})
+	o.Log.Debug("Saved converted image " + convertedimagekey + " to cache")
+	return sharedResult{image: image, headers: &convertedHeaders, expires: base.expires}, nil
+}
+
+// getBaseImage returns the source image from the cache or loads it from the network and caches it,
+// expired cached images are revalidated with the source server first. Within the stale policy of
+// the origin an expired image is served while it is revalidated in the background or when the
+// revalidation fails. Requests for a source that is being downloaded wait for that download, which
+// is canceled only when all of them are gone.
+func (o *Server) getBaseImage(ctx context.Context, baseimagekey string, h *http.Header) (sharedResult, error) {
+	now := time.Now()
+	ci, found := o.BaseImageCache.Get(baseimagekey)
+	stale := sharedResult{image: ci.Content, headers: &ci.Headers, expires: ci.Expires}
+	if found && !ci.Expired(now) {
+		return stale, nil
+	}
+	var cached *lrufilecache.CacheItem
+	if found {
+		cached = &ci
+	}
+	policy := o.stalePolicy(baseimagekey)
+
+	if found && policy.whileRevalidate(ci, now) && ctx.Value(syncRefreshKey{}) == nil {
+		h = cloneHeader(h)
+		o.refreshInBackground(&o.fetches, baseimagekey, func(ctx context.Context) (sharedResult, error) {
+			return o.fetchBaseImage(ctx, baseimagekey, h, cached)
+		})
+		return stale, nil
+	}
+
+	res, err := o.fetches.Do(ctx, baseimagekey, func(ctx context.Context) (sharedResult, error) {
+		return o.fetchBaseImage(ctx, baseimagekey, h, cached)
+	})
+	if err != nil && found && policy.ifError(ci, now, err) {
+		o.Log.Warn(fmt.Sprintf("serving stale base image %s as its origin failed: %s", baseimagekey, err))
+		return stale, nil
+	}
+	if res.headers == nil {
+		res.headers = &http.Header{}
+	}
+	return res, err
+}
 
-			o.ConvertedImageCache.Set(convertedimagekey, lrufilecache.CacheItem{
-				Content: image, Headers: cleanHeaders(imageResponseHeaders),
-			})
-			o.Log.Debug("Saved converted image " + convertedimagekey + " to cache")
+// fetchBaseImage downloads the source image, validates it and puts it into the cache. With a cached
+// image the download is conditional and only refreshes its headers and expiry if it has not changed.
+func (o *Server) fetchBaseImage(
+	ctx context.Context, baseimagekey string, h *http.Header, cached *lrufilecache.CacheItem,
+) (sharedResult, error) {
+	var conditions http.Header
+	if cached != nil {
+		conditions = conditionalHeaders(cached.Headers)
+	}
+	image, headers, err := o.loadImageIfModified(ctx, baseimagekey, h, conditions)
+	if errors.Is(err, errNotModified) {
+		refreshed := cached.Headers.Clone()
+		for key, values := range cleanHeaders(headers) {
+			refreshed[key] = values
+		}
+		ci := lrufilecache.CacheItem{
+			Content: cached.Content, Headers: refreshed, Expires: o.cacheExpiry(refreshed, time.Now()),
 		}
+		o.BaseImageCache.Set(baseimagekey, ci)
+		o.Log.Debug("Revalidated base image " + baseimagekey + " with server")
+		return sharedResult{image: ci.Content, headers: &ci.Headers, expires: ci.Expires}, nil
+	}
+	if err != nil {
+		return sharedResult{headers: headers}, err
+	}
+
+	err = o.checkImage(image, baseimagekey)
+	if err != nil {
+		return sharedResult{headers: headers}, err
+	}
+
+	err = o.checkSourcePixels(image, baseimagekey)
+	if err != nil {
+		return sharedResult{headers: headers}, err
+	}
 
-		writeHeaders(imageResponseHeaders, w)
+	expires := o.cacheExpiry(*headers, time.Now())
+	o.BaseImageCache.Set(baseimagekey, lrufilecache.CacheItem{
+		Content: image,
+		Headers: cleanHeaders(headers),
+		Expires: expires,
+	})
+	o.Log.Debug("Loaded base image " + baseimagekey + " from server and saved it to cache")
+	return sharedResult{image: image, headers: headers, expires: expires}, nil
+}
 
-		mime := GetImageMimeType(bimg.DetermineImageType(image))
-		w.Header().Set("Content-Type", mime)
-		w.Write(image)
+// getBaseImageSize returns the dimensions of the source image loading it if it is not cached.
+func (o *Server) getBaseImageSize(ctx context.Context, baseimagekey string, h *http.Header) (ImageSize, error) {
+	base, err := o.getBaseImage(ctx, baseimagekey, h)
+	if err != nil {
+		return ImageSize{}, err
 	}
+	return processingEngine().Size(base.image)
 }
 
 func (o *Server) indexRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -231,6 +492,7 @@ func (o *Server) indexRoute(w http.ResponseWriter, r *http.Request, _ httprouter
 	w.Write(body)
 }
 
+// parseDimensions parses WxH, a zero dimension is derived from the aspect ratio of the source.
 func parseDimensions(value string) (int, int, error) {
 	var width, height int
 
@@ -243,36 +505,58 @@ func parseDimensions(value string) (int, int, error) {
 	if len(size) > 1 {
 		height, err = strconv.Atoi(size[1])
 	}
+	if err == nil && (width < 0 || height < 0) {
+		return 0, 0, fmt.Errorf("invalid width or height provided: (size=%s)", value)
+	}
 
 	return width, height, err
 }
 
-func imageOK(image []byte) bool {
-	b := bimg.NewImage(image)
-	if b == nil {
-		return false
+// checkImage returns ErrNotImage if the source is not an image of an accepted format and
+// ErrUndecodable if it is one but cannot be decoded.
+func (o *Server) checkImage(image []byte, url string) error {
+	// vector sources are only accepted when enabled in configuration
+	imageType := DetermineImageType(image)
+	if imageType == UNKNOWN || (imageType == SVG && !o.AllowSVG) || (imageType == PDF && !o.AllowPDF) {
+		return fmt.Errorf("%w: (url=%s)", ErrNotImage, url)
 	}
-	_, err := b.Size()
-	return err == nil
-}
 
-func (o *Server) failed(w http.ResponseWriter, opts Options, msg string) {
-	opts.Force = true
-	image, err := Resize(o.ErrorImage, opts)
+	_, err := processingEngine().Size(image)
 	if err != nil {
-		o.failedRequest(w, err.Error())
+		return fmt.Errorf("%w: %w (url=%s)", ErrUndecodable, err, url)
+	}
+	return nil
+}
+
+// failed answers with the status matching err and the error image resized as requested.
+func (o *Server) failed(w http.ResponseWriter, r *http.Request, source string, opts Options, err error) {
+	status, code := errorStatus(err)
+	p := problem{Status: status, Code: code, Detail: err.Error(), Source: source}
+	errorImage := o.errorImage(code)
+	if o.NoErrorImage || wantsProblem(r) || o.checkDimensions(opts.Width, opts.Height) != nil {
+		// the error image is not made larger than allowed
+		o.writeError(w, r, p, errorImage)
 		return
 	}
+	// only the size of the request is applied to the error image
+	opts = Options{Width: opts.Width, Height: opts.Height, Operation: opts.Operation, Force: true}
+	image, rerr := Resize(errorImage, opts)
+	if rerr != nil {
+		image = errorImage
+	}
+	o.writeError(w, r, p, image)
+}
 
-	w.Header().Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(image)))
-	w.Header().Set("Error", msg)
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write(image)
+// busy asks the client to retry later as the server has no capacity for the request.
+func (o *Server) busy(w http.ResponseWriter, r *http.Request, msg string) {
+	retryAfter := o.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	o.writeError(w, r, problem{Status: http.StatusServiceUnavailable, Code: "server_busy", Detail: msg}, o.ErrorImage)
 }
 
-func (o *Server) failedRequest(w http.ResponseWriter, msg string) {
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Error", msg)
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write(o.ErrorImage)
+func (o *Server) failedRequest(w http.ResponseWriter, r *http.Request, msg string) {
+	o.writeError(w, r, problem{Status: http.StatusBadRequest, Code: "bad_request", Detail: msg}, o.ErrorImage)
 }
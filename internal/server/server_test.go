@@ -1,8 +1,26 @@
 package internalhttp
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/Dmit1812/imgresizr/internal/logger"
+	"github.com/Dmit1812/imgresizr/internal/lrufilecache"
+)
 
 func TestServer(t *testing.T) {
 	// TODO
 	_ = t
 }
+
+// newTestServer returns a server with quiet logging and its caches in a temporary directory.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	log := logger.New(logger.ERROR)
+	return &Server{
+		HTTPReadTimeout:     5,
+		Log:                 log,
+		BaseImageCache:      lrufilecache.NewLRUFileCache(10, 10, dir+"/base", log),
+		ConvertedImageCache: lrufilecache.NewLRUFileCache(10, 10, dir+"/converted", log),
+	}
+}
@@ -0,0 +1,290 @@
+package internalhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dmit1812/imgresizr/internal/lrufilecache"
+)
+
+const (
+	spritePath     = "/sprite"
+	spriteJSONPath = "/sprite.json"
+
+	spriteMaxCells    = 100
+	spriteMaxCellSize = 4096
+	spriteMaxGap      = 100
+)
+
+// spriteLayout describes a grid of thumbnails composed into a single image.
+type spriteLayout struct {
+	URLs                  []string
+	CellWidth, CellHeight int
+	Cols, Gap             int
+	Operation             string // fill crops the sources to the cell, fit keeps them whole
+	Background            color.NRGBA
+	Format                ImageType
+	Quality               int
+}
+
+// spriteCell is the position of one source in the sprite, as returned for CSS sprites.
+type spriteCell struct {
+	URL    string `json:"url"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type spriteMap struct {
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Cells  []spriteCell `json:"cells"`
+}
+
+// spriteRoute composes the sources into a sprite, or with the json path only returns the coordinates of the cells.
+// Query: url (repeated), cell=WxH, cols, gap, bg, op=fill|fit, format, quality.
+func (o *Server) spriteRoute() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			o.Log.Error(fmt.Sprintf("unsupported method %s", r.Method))
+			o.failedRequest(w, r, "the method is not allowed")
+			return
+		}
+
+		layout, err := parseSpriteQuery(r.URL.Query())
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedRequest(w, r, err.Error())
+			return
+		}
+
+		// refuse sprites over the limits before anything is fetched
+		err = o.checkDimensions(layout.size())
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedSource(w, r, "", err)
+			return
+		}
+
+		if r.URL.Path == spriteJSONPath {
+			body, _ := json.Marshal(layout.coordinates())
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+
+		key := layout.cacheKey()
+		ci, found := o.ConvertedImageCache.Get(key)
+		image := ci.Content
+		if !found || ci.Expired(time.Now()) {
+			var res sharedResult
+			res, err = o.conversions.Do(r.Context(), key, func(ctx context.Context) (sharedResult, error) {
+				o.Log.Info(fmt.Sprintf("will compose sprite of %d images", len(layout.URLs)))
+				image, expires, err := o.composeSprite(ctx, layout, &r.Header)
+				if err != nil {
+					return sharedResult{}, err
+				}
+				// the sprite expires along with the first of its sources
+				o.ConvertedImageCache.Set(key, lrufilecache.CacheItem{Content: image, Headers: http.Header{}, Expires: expires})
+				o.Log.Debug("Saved sprite " + key + " to cache")
+				return sharedResult{image: image, expires: expires}, nil
+			})
+			if errors.Is(err, ErrServerBusy) {
+				o.Log.Warn(err.Error())
+				o.busy(w, r, err.Error())
+				return
+			}
+			if err != nil {
+				o.Log.Error(err.Error())
+				o.failedSource(w, r, "", err)
+				return
+			}
+			image = res.image
+		}
+
+		w.Header().Set("Content-Type", GetImageMimeType(DetermineImageType(image)))
+		o.startSending(w)
+		w.Write(image)
+	}
+}
+
+// composeSprite loads the sources through the base image cache, resizes them to the cell size
+// and draws them onto the grid. It returns the sprite with the earliest expiry of the sources.
+func (o *Server) composeSprite(
+	ctx context.Context, layout spriteLayout, h *http.Header,
+) ([]byte, time.Time, error) {
+	cells := make([]image.Image, len(layout.URLs))
+	expiries := make([]time.Time, len(layout.URLs))
+	errs := make([]error, len(layout.URLs))
+	var wg sync.WaitGroup
+	for i, u := range layout.URLs {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			cells[i], expiries[i], errs[i] = o.spriteThumbnail(ctx, u, layout, h)
+		}(i, u)
+	}
+	wg.Wait()
+
+	var expires time.Time
+	for i := range cells {
+		if errs[i] != nil {
+			return nil, time.Time{}, errs[i]
+		}
+		if !expiries[i].IsZero() && (expires.IsZero() || expiries[i].Before(expires)) {
+			expires = expiries[i]
+		}
+	}
+
+	width, height := layout.size()
+	sprite, err := o.process(ctx, int64(width)*int64(height), func() ([]byte, error) {
+		canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(layout.Background), image.Point{}, draw.Src)
+		for i, thumbnail := range cells {
+			// thumbnails smaller than the cell are centered in it
+			cell := layout.cell(i)
+			b := thumbnail.Bounds()
+			offset := image.Pt((cell.Dx()-b.Dx())/2, (cell.Dy()-b.Dy())/2)
+			draw.Draw(canvas, b.Sub(b.Min).Add(cell.Min).Add(offset), thumbnail, b.Min, draw.Over)
+		}
+		return encodeImage(canvas, layout.Format, Options{Quality: layout.Quality})
+	})
+	return sprite, expires, err
+}
+
+func (o *Server) spriteThumbnail(
+	ctx context.Context, u string, layout spriteLayout, h *http.Header,
+) (image.Image, time.Time, error) {
+	base, err := o.getBaseImage(ctx, u, h)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	source := base.image
+	buf, err := o.process(ctx, int64(layout.CellWidth)*int64(layout.CellHeight), func() ([]byte, error) {
+		return Resize(source, Options{
+			Width: layout.CellWidth, Height: layout.CellHeight, Operation: layout.Operation, Format: PNG,
+		})
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	thumbnail, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to decode resized image: %w (url=%s)", err, u)
+	}
+	return thumbnail, base.expires, nil
+}
+
+// parseSpriteQuery reads the sprite layout from the query string.
+func parseSpriteQuery(q url.Values) (spriteLayout, error) {
+	layout := spriteLayout{URLs: q["url"], Operation: "fill", Background: colorWhite, Format: JPEG}
+	if len(layout.URLs) == 0 || len(layout.URLs) > spriteMaxCells {
+		return layout, fmt.Errorf("invalid number of sprite images provided: (images=%d) (max=%d)",
+			len(layout.URLs), spriteMaxCells)
+	}
+	for _, u := range layout.URLs {
+		if u == "" {
+			return layout, errors.New("empty sprite image URL provided")
+		}
+	}
+
+	var err error
+	layout.CellWidth, layout.CellHeight, err = parseDimensions(q.Get("cell"))
+	if err != nil || layout.CellWidth < 1 || layout.CellHeight < 1 ||
+		layout.CellWidth > spriteMaxCellSize || layout.CellHeight > spriteMaxCellSize {
+		return layout, fmt.Errorf("invalid sprite cell size provided: (cell=%s) (max=%d)", q.Get("cell"), spriteMaxCellSize)
+	}
+
+	layout.Cols = int(math.Ceil(math.Sqrt(float64(len(layout.URLs)))))
+	if v := q.Get("cols"); v != "" {
+		layout.Cols, err = strconv.Atoi(v)
+		if err != nil || layout.Cols < 1 {
+			return layout, fmt.Errorf("invalid sprite columns provided: (cols=%s)", v)
+		}
+	}
+	layout.Cols = min(layout.Cols, len(layout.URLs))
+
+	if v := q.Get("gap"); v != "" {
+		layout.Gap, err = strconv.Atoi(v)
+		if err != nil || layout.Gap < 0 || layout.Gap > spriteMaxGap {
+			return layout, fmt.Errorf("invalid sprite gap provided: (gap=%s)", v)
+		}
+	}
+
+	if v := q.Get("op"); v != "" {
+		if v != "fill" && v != "fit" {
+			return layout, fmt.Errorf("unsupported sprite operation: (op=%s)", v)
+		}
+		layout.Operation = v
+	}
+
+	if v := q.Get("bg"); v != "" {
+		layout.Background, err = parseColor(v)
+		if err != nil {
+			return layout, err
+		}
+		if layout.Background.A < 255 {
+			layout.Format = PNG
+		}
+	}
+
+	if v := q.Get("quality"); v != "" {
+		layout.Quality, err = strconv.Atoi(v)
+		if err != nil || layout.Quality < 1 || layout.Quality > 100 {
+			return layout, fmt.Errorf("invalid quality provided: (quality=%s)", v)
+		}
+	}
+
+	if v := q.Get("format"); v != "" {
+		format, ok := formatsByName[strings.ToLower(v)]
+		if !ok {
+			return layout, fmt.Errorf("unsupported output format: (format=%s)", v)
+		}
+		layout.Format = format
+	}
+	return layout, nil
+}
+
+// size returns the dimensions of the whole sprite.
+func (l spriteLayout) size() (int, int) {
+	rows := (len(l.URLs) + l.Cols - 1) / l.Cols
+	return l.Cols*l.CellWidth + (l.Cols-1)*l.Gap, rows*l.CellHeight + (rows-1)*l.Gap
+}
+
+// cell returns the area of the i-th source in the sprite, sources fill the grid row by row.
+func (l spriteLayout) cell(i int) image.Rectangle {
+	x := (i % l.Cols) * (l.CellWidth + l.Gap)
+	y := (i / l.Cols) * (l.CellHeight + l.Gap)
+	return image.Rect(x, y, x+l.CellWidth, y+l.CellHeight)
+}
+
+func (l spriteLayout) coordinates() spriteMap {
+	width, height := l.size()
+	m := spriteMap{Width: width, Height: height, Cells: make([]spriteCell, 0, len(l.URLs))}
+	for i, u := range l.URLs {
+		cell := l.cell(i)
+		m.Cells = append(m.Cells, spriteCell{URL: u, X: cell.Min.X, Y: cell.Min.Y, Width: cell.Dx(), Height: cell.Dy()})
+	}
+	return m
+}
+
+func (l spriteLayout) cacheKey() string {
+	key := fmt.Sprintf("sprite/%s/%dx%d/cols%d/gap%d/%s/q%d/%s", l.Operation, l.CellWidth, l.CellHeight,
+		l.Cols, l.Gap, formatColor(l.Background), l.Quality, ImageTypes[l.Format])
+	return key + "-" + strings.Join(l.URLs, "|")
+}
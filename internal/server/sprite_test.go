@@ -0,0 +1,96 @@
+package internalhttp
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpriteQuery(t *testing.T) {
+	t.Parallel()
+	q, err := url.ParseQuery("url=a.jpg&url=b.jpg&url=c.jpg&cell=100x50&gap=2&op=fit&bg=transparent")
+	require.NoError(t, err)
+	layout, err := parseSpriteQuery(q)
+	require.NoError(t, err)
+	require.Equal(t, spriteLayout{
+		URLs: []string{"a.jpg", "b.jpg", "c.jpg"}, CellWidth: 100, CellHeight: 50, Cols: 2, Gap: 2,
+		Operation: "fit", Format: PNG,
+	}, layout)
+
+	for _, query := range []string{
+		"cell=100x50", "url=a.jpg", "url=a.jpg&cell=100", "url=a.jpg&cell=0x10", "url=a.jpg&cell=10x10&cols=0",
+		"url=a.jpg&cell=10x10&gap=-1", "url=a.jpg&cell=10x10&op=crop", "url=a.jpg&cell=10x10&format=tiff",
+		"url=&cell=10x10", "url=a.jpg&cell=5000x10", "url=a.jpg&cell=10x10&gap=101",
+	} {
+		q, err = url.ParseQuery(query)
+		require.NoError(t, err)
+		_, err = parseSpriteQuery(q)
+		require.Error(t, err, query)
+	}
+}
+
+func TestSpriteCoordinates(t *testing.T) {
+	t.Parallel()
+	layout := spriteLayout{URLs: []string{"a", "b", "c", "d", "e"}, CellWidth: 100, CellHeight: 50, Cols: 3, Gap: 2}
+	require.Equal(t, spriteMap{
+		Width: 304, Height: 102,
+		Cells: []spriteCell{
+			{URL: "a", X: 0, Y: 0, Width: 100, Height: 50},
+			{URL: "b", X: 102, Y: 0, Width: 100, Height: 50},
+			{URL: "c", X: 204, Y: 0, Width: 100, Height: 50},
+			{URL: "d", X: 0, Y: 52, Width: 100, Height: 50},
+			{URL: "e", X: 102, Y: 52, Width: 100, Height: 50},
+		},
+	}, layout.coordinates())
+}
+
+func TestSpriteRouteLimits(t *testing.T) {
+	t.Parallel()
+	o := newTestServer(t)
+	o.MaxWidth, o.NoErrorImage = 100, true
+	mux := o.NewServerMux()
+	sources := "?url=a.invalid/a.jpg&url=a.invalid/b.jpg&cell=50x50"
+
+	// the sources are not fetched for a sprite over the limits
+	for _, path := range []string{spritePath, spriteJSONPath} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path+sources+"&gap=1", nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, path)
+		require.Equal(t, "dimensions_too_large", w.Header().Get(HeaderErrorCode), path)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, spriteJSONPath+sources, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestSpriteRouteExpires(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a.png" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		buf, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	mux := o.NewServerMux()
+	q := url.Values{"url": {ts.URL + "/a.png", ts.URL + "/b.png"}, "cell": {"10x10"}}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, spritePath+"?"+q.Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Header().Get("Error"))
+
+	// the sprite expires with the source that expires first
+	layout, err := parseSpriteQuery(q)
+	require.NoError(t, err)
+	ci, found := o.ConvertedImageCache.Get(layout.cacheKey())
+	require.True(t, found)
+	require.WithinDuration(t, time.Now().Add(time.Minute), ci.Expires, 10*time.Second)
+}
@@ -0,0 +1,133 @@
+package internalhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Dmit1812/imgresizr/pkg/workpool"
+)
+
+var (
+	ErrServerBusy = errors.New("server is busy, try again later")
+	ErrConversion = errors.New("conversion failed")
+)
+
+// sharedResult is the outcome of a source download or a conversion shared by the requests waiting for it.
+type sharedResult struct {
+	image   []byte
+	headers *http.Header
+	expires time.Time // when the source image has to be revalidated, never if zero
+}
+
+// stageContext derives the context of a processing stage with its own budget in seconds, the budget
+// is unlimited if 0.
+func stageContext(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+// process runs the conversion on a worker of the pool within the processing budget, cost is the number
+// of pixels it produces, cheaper conversions go first when the queue is prioritized.
+// A running conversion cannot be interrupted, when the client is gone or the budget is over its result
+// is dropped and the caller returns right away. Failures of the conversion wrap ErrConversion.
+func (o *Server) process(ctx context.Context, cost int64, convert func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("conversion skipped: %w", err)
+	}
+
+	release, err := o.acquireWorker(ctx, cost)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := stageContext(ctx, o.ProcessTimeout)
+	defer cancel()
+
+	type result struct {
+		buf []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// the worker is busy until the conversion ends even if nobody waits for it anymore
+		defer release()
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("%w: panicked: %v", ErrConversion, r)}
+			}
+		}()
+		buf, err := convert()
+		done <- result{buf, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrConversion, res.err)
+		}
+		return res.buf, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("conversion abandoned: %w", ctx.Err())
+	}
+}
+
+// conversionCost returns the number of pixels the conversion produces.
+func conversionCost(opts Options, image []byte) int64 {
+	w, h := opts.Width, opts.Height
+	if w <= 0 || h <= 0 {
+		if size, err := processingEngine().Size(image); err == nil {
+			w, h = outputSize(opts, size)
+		}
+	}
+	return int64(w) * int64(h)
+}
+
+// acquireWorker waits in the queue for a free worker, a full queue or a wait over the queue budget
+// fail with ErrServerBusy. Without the worker limit conversions run right away.
+func (o *Server) acquireWorker(ctx context.Context, cost int64) (func(), error) {
+	pool := o.workerPool()
+	if pool == nil {
+		return func() {}, nil
+	}
+
+	if !o.PrioritizeSmall {
+		cost = 0
+	}
+	queueCtx, cancel := stageContext(ctx, o.QueueTimeout)
+	defer cancel()
+	release, err := pool.Acquire(queueCtx, cost)
+	switch {
+	case errors.Is(err, workpool.ErrQueueFull):
+		return nil, fmt.Errorf("%w: (queue=%d)", ErrServerBusy, o.QueueSize)
+	case err != nil && ctx.Err() == nil:
+		return nil, fmt.Errorf("%w: (waited=%ds)", ErrServerBusy, o.QueueTimeout)
+	case err != nil:
+		return nil, fmt.Errorf("conversion skipped: %w", err)
+	}
+	return release, nil
+}
+
+// workerPool returns the pool conversions run on, nil without the worker limit.
+func (o *Server) workerPool() *workpool.Pool {
+	o.poolOnce.Do(func() {
+		if o.Workers > 0 {
+			o.pool = workpool.New(o.Workers, o.QueueSize)
+		}
+	})
+	return o.pool
+}
+
+// startSending gives writing the response its own budget, it replaces the write timeout of the server
+// which is counted from the start of the request.
+func (o *Server) startSending(w http.ResponseWriter) {
+	if o.SendTimeout <= 0 {
+		return
+	}
+	// writers without deadline support keep the server write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Duration(o.SendTimeout) * time.Second))
+}
@@ -0,0 +1,111 @@
+package internalhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcess(t *testing.T) {
+	t.Parallel()
+	o := &Server{}
+
+	buf, err := o.process(context.Background(), 1, func() ([]byte, error) { return []byte{1}, nil })
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	_, err = o.process(ctx, 1, func() ([]byte, error) {
+		called = true
+		return nil, nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, called, "the conversion should not start for a gone client")
+
+	_, err = o.process(context.Background(), 1, func() ([]byte, error) { panic("boom") })
+	require.ErrorIs(t, err, ErrConversion)
+	require.ErrorContains(t, err, "panicked: boom")
+
+	// the client leaving during the conversion does not keep the request waiting for it
+	ctx, cancel = context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = o.process(ctx, 1, func() ([]byte, error) {
+		<-release
+		return nil, nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestLoadImageCanceled(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	o := &Server{HTTPReadTimeout: 30}
+	_, _, err := o.LoadImageFromNetwork(ctx, ts.URL, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestServeImageInvalidURL(t *testing.T) {
+	t.Parallel()
+	o := newTestServer(t)
+	o.NoErrorImage = true
+	w := httptest.NewRecorder()
+	o.NewServerMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/a.com/%25zz", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Header().Get("Error"), "invalid image URL")
+}
+
+func TestProcessBusy(t *testing.T) {
+	t.Parallel()
+	o := &Server{Workers: 1, QueueSize: 1, QueueTimeout: 1, RetryAfter: 3}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := o.process(context.Background(), 1, func() ([]byte, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		done <- err
+	}()
+	<-started
+
+	// the only place in the queue is taken until the wait budget is over
+	queued := make(chan error, 1)
+	go func() {
+		_, err := o.process(context.Background(), 1, func() ([]byte, error) { return nil, nil })
+		queued <- err
+	}()
+	require.Eventually(t, func() bool { _, waiting := o.pool.Stats(); return waiting == 1 }, time.Second, time.Millisecond)
+
+	_, err := o.process(context.Background(), 1, func() ([]byte, error) { return nil, nil })
+	require.ErrorIs(t, err, ErrServerBusy)
+	require.ErrorIs(t, <-queued, ErrServerBusy)
+
+	close(release)
+	require.NoError(t, <-done)
+
+	w := httptest.NewRecorder()
+	o.busy(w, httptest.NewRequest(http.MethodGet, "/", nil), err.Error())
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "3", w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,88 @@
+package internalhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Dmit1812/imgresizr/internal/lrufilecache"
+	"github.com/Dmit1812/imgresizr/pkg/flight"
+)
+
+// StalePolicy tells how long past their expiry cached images are still served.
+type StalePolicy struct {
+	WhileRevalidate int // seconds a stale image is served right away while it is refreshed in the background
+	IfError         int // seconds a stale image is served when its origin fails
+}
+
+// syncRefreshKey marks the context of a background refresh, the stale source images it needs
+// are revalidated before use rather than served as they are.
+type syncRefreshKey struct{}
+
+// ParseStalePolicies parses the per origin policies given as host=while-revalidate/if-error
+// separated by commas, e.g. "img.example.com=60/86400,cdn.example.com:8080=0/3600".
+func ParseStalePolicies(spec string) (map[string]StalePolicy, error) {
+	policies := map[string]StalePolicy{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, seconds, ok := strings.Cut(entry, "=")
+		whileRevalidate, ifError, ok2 := strings.Cut(seconds, "/")
+		p := StalePolicy{WhileRevalidate: parseSeconds(whileRevalidate), IfError: parseSeconds(ifError)}
+		if !ok || !ok2 || host == "" || p.WhileRevalidate < 0 || p.IfError < 0 {
+			return nil, fmt.Errorf("invalid stale policy, expected host=seconds/seconds: (policy=%s)", entry)
+		}
+		policies[host] = p
+	}
+	return policies, nil
+}
+
+// stalePolicy returns the policy of the origin of the source image, the global one if it has none.
+func (o *Server) stalePolicy(source string) StalePolicy {
+	if u, err := url.Parse(addHTTPSToURL(source)); err == nil {
+		if p, ok := o.OriginStalePolicies[u.Host]; ok {
+			return p
+		}
+	}
+	return o.StalePolicy
+}
+
+// whileRevalidate tells whether the expired item may be served while it is refreshed.
+func (p StalePolicy) whileRevalidate(ci lrufilecache.CacheItem, now time.Time) bool {
+	return p.WhileRevalidate > 0 && now.Before(ci.Expires.Add(time.Duration(p.WhileRevalidate)*time.Second))
+}
+
+// ifError tells whether the expired item may be served in place of the failure to refresh it.
+func (p StalePolicy) ifError(ci lrufilecache.CacheItem, now time.Time, err error) bool {
+	// only failures of the origin count, a missing image or a busy server is answered as such
+	status, _ := errorStatus(err)
+	return p.IfError > 0 && (status == http.StatusBadGateway || status == http.StatusGatewayTimeout) &&
+		now.Before(ci.Expires.Add(time.Duration(p.IfError)*time.Second))
+}
+
+// refreshInBackground refreshes a stale cache item while no client waits for it, a refresh of the key
+// already in flight is joined instead.
+func (o *Server) refreshInBackground(
+	group *flight.Group[sharedResult], key string, refresh func(ctx context.Context) (sharedResult, error),
+) {
+	ctx := context.WithValue(context.Background(), syncRefreshKey{}, true)
+	go func() {
+		if _, err := group.Do(ctx, key, refresh); err != nil {
+			o.Log.Warn(fmt.Sprintf("background refresh of %s failed: %s", key, err))
+		}
+	}()
+}
+
+// cloneHeader copies the request headers for a refresh outliving the request.
+func cloneHeader(h *http.Header) *http.Header {
+	if h == nil {
+		return nil
+	}
+	c := h.Clone()
+	return &c
+}
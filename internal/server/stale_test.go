@@ -0,0 +1,110 @@
+package internalhttp
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStalePolicies(t *testing.T) {
+	policies, err := ParseStalePolicies(" a.example.com=60/3600, b.example.com:8080=0/10 ,")
+	require.NoError(t, err)
+	require.Equal(t, map[string]StalePolicy{
+		"a.example.com":      {WhileRevalidate: 60, IfError: 3600},
+		"b.example.com:8080": {WhileRevalidate: 0, IfError: 10},
+	}, policies)
+
+	policies, err = ParseStalePolicies("")
+	require.NoError(t, err)
+	require.Empty(t, policies)
+
+	for _, spec := range []string{"a.example.com", "a.example.com=60", "=1/2", "a.example.com=-1/2", "a=x/1"} {
+		_, err = ParseStalePolicies(spec)
+		require.Error(t, err, spec)
+	}
+
+	o := &Server{
+		StalePolicy:         StalePolicy{IfError: 1},
+		OriginStalePolicies: map[string]StalePolicy{"a.example.com": {IfError: 2}},
+	}
+	require.Equal(t, 2, o.stalePolicy("http://a.example.com/img.jpg").IfError)
+	require.Equal(t, 2, o.stalePolicy("a.example.com/img.jpg").IfError)
+	require.Equal(t, 1, o.stalePolicy("http://c.example.com/img.jpg").IfError)
+}
+
+// staleOrigin serves a 20x20 PNG that expires at once until it is told to fail with the status.
+func staleOrigin(t *testing.T) (*httptest.Server, *int32, *atomic.Int32) {
+	t.Helper()
+	var hits int32
+	var failWith atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if status := failWith.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		png, _ := encodePNG(image.NewNRGBA(image.Rect(0, 0, 20, 20)))
+		w.Write(png)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &hits, &failWith
+}
+
+func TestGetBaseImageStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	ts, hits, _ := staleOrigin(t)
+	o := newTestServer(t)
+	o.StalePolicy = StalePolicy{WhileRevalidate: 60}
+
+	_, err := o.getBaseImage(context.Background(), ts.URL, nil)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(hits))
+
+	// the stale image is served right away and refreshed in the background
+	base, err := o.getBaseImage(context.Background(), ts.URL, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, base.image)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(hits) == 2 && o.fetches.Waiters(ts.URL) == 0
+	}, time.Second, time.Millisecond)
+
+	// a background refresh revalidates before use
+	ctx := context.WithValue(context.Background(), syncRefreshKey{}, true)
+	_, err = o.getBaseImage(ctx, ts.URL, nil)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(hits))
+}
+
+func TestServeImageStaleIfError(t *testing.T) {
+	t.Parallel()
+	ts, hits, failWith := staleOrigin(t)
+	o := newTestServer(t)
+	o.NoErrorImage, o.StalePolicy = true, StalePolicy{IfError: 60}
+	opts := Options{Operation: "fill", Width: 10, Height: 10}
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		o.serveImage(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/"+ts.URL, nil),
+			o.ConvertedImageCache, ts.URL, opts)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, serve().Code)
+
+	// a failing origin gets the stale image served
+	failWith.Store(http.StatusInternalServerError)
+	w := serve()
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get(HeaderErrorCode))
+	require.Equal(t, int32(2), atomic.LoadInt32(hits), "the origin should be asked first")
+
+	// an image gone from the origin is not served anymore
+	failWith.Store(http.StatusNotFound)
+	require.Equal(t, http.StatusNotFound, serve().Code)
+}
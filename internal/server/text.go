@@ -0,0 +1,182 @@
+package internalhttp
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	defaultFontSize     = 24
+	maxFontSize         = 1000
+	defaultTextPosition = "south"
+)
+
+var (
+	fontExtensions = []string{".ttf", ".otf"}
+
+	textPositions = map[string]bool{
+		"center": true, "north": true, "south": true, "east": true, "west": true,
+		"northeast": true, "northwest": true, "southeast": true, "southwest": true,
+	}
+
+	defaultFont     *opentype.Font
+	defaultFontOnce sync.Once
+
+	ErrFontNotFound = errors.New("font not found")
+)
+
+// Text describes a caption rendered onto the resized image.
+type Text struct {
+	Content  string
+	FontName string         // font file name without extension in the font directory
+	Font     *opentype.Font // font loaded by the server, the built in font is used if nil
+	Size     float64        // font size in pixels
+	Color    color.NRGBA
+	Position string // gravity of the text block: center, north, southeast, ...
+	Width    int    // width to wrap the text at, 0 wraps at the image width
+}
+
+func (t Text) isSet() bool {
+	return t.Content != ""
+}
+
+func (t Text) String() string {
+	return fmt.Sprintf("%s:%s:%g:%s:%d:%s",
+		t.FontName, formatColor(t.Color), t.Size, t.Position, t.Width, t.Content)
+}
+
+// loadFont returns the font with the given name from the font directory, fonts are kept in memory once loaded.
+// Without a font directory the built in font is used for every name.
+func (o *Server) loadFont(name string) (*opentype.Font, error) {
+	if name == "" || o.FontPath == "" {
+		return nil, nil
+	}
+	if f, ok := o.fonts.Load(name); ok {
+		return f.(*opentype.Font), nil
+	}
+	// font names are file names, do not allow to walk out of the font directory
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("%w: (font=%s)", ErrFontNotFound, name)
+	}
+
+	for _, ext := range fontExtensions {
+		data, err := os.ReadFile(path.Join(o.FontPath, name+ext))
+		if err != nil {
+			continue
+		}
+		f, err := opentype.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse font: %w (font=%s)", err, name)
+		}
+		o.fonts.Store(name, f)
+		return f, nil
+	}
+	return nil, fmt.Errorf("%w: (font=%s)", ErrFontNotFound, name)
+}
+
+func builtinFont() *opentype.Font {
+	defaultFontOnce.Do(func() {
+		defaultFont, _ = opentype.Parse(goregular.TTF)
+	})
+	return defaultFont
+}
+
+// drawText renders the wrapped text onto the image at the requested position.
+func drawText(dst draw.Image, t Text) error {
+	f := t.Font
+	if f == nil {
+		f = builtinFont()
+	}
+	bounds := dst.Bounds()
+	// letters higher than the image cannot be seen anyway
+	size := min(t.Size, float64(bounds.Dy()))
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return fmt.Errorf("unable to create font face: %w", err)
+	}
+	defer face.Close()
+
+	margin := int(math.Ceil(size / 2))
+	width := t.Width
+	if width <= 0 || width > bounds.Dx()-2*margin {
+		width = bounds.Dx() - 2*margin
+	}
+
+	lines := wrapText(face, t.Content, width)
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	blockWidth := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > blockWidth {
+			blockWidth = w
+		}
+	}
+	blockHeight := lineHeight * len(lines)
+
+	// place the text block inside the image according to its gravity
+	x := bounds.Min.X + (bounds.Dx()-blockWidth)/2
+	y := bounds.Min.Y + (bounds.Dy()-blockHeight)/2
+	if strings.HasSuffix(t.Position, "west") {
+		x = bounds.Min.X + margin
+	}
+	if strings.HasSuffix(t.Position, "east") {
+		x = bounds.Max.X - margin - blockWidth
+	}
+	if strings.HasPrefix(t.Position, "north") {
+		y = bounds.Min.Y + margin
+	}
+	if strings.HasPrefix(t.Position, "south") {
+		y = bounds.Max.Y - margin - blockHeight
+	}
+
+	drawer := &font.Drawer{Dst: dst, Src: image.NewUniform(t.Color), Face: face}
+	for i, line := range lines {
+		// lines are aligned to the side of the gravity, centered otherwise
+		lineWidth := font.MeasureString(face, line).Ceil()
+		lx := x + (blockWidth-lineWidth)/2
+		if strings.HasSuffix(t.Position, "west") {
+			lx = x
+		}
+		if strings.HasSuffix(t.Position, "east") {
+			lx = x + blockWidth - lineWidth
+		}
+		drawer.Dot = fixed.P(lx, y+i*lineHeight+metrics.Ascent.Ceil())
+		drawer.DrawString(line)
+	}
+	return nil
+}
+
+// wrapText splits the text into lines not wider than width, words longer than width get a line of their own.
+func wrapText(face font.Face, text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && font.MeasureString(face, candidate).Ceil() > width {
+				lines = append(lines, line)
+				line = word
+				continue
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
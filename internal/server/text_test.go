@@ -0,0 +1,97 @@
+package internalhttp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+)
+
+func TestWrapText(t *testing.T) {
+	t.Parallel()
+	face, err := opentype.NewFace(builtinFont(), &opentype.FaceOptions{Size: 10, DPI: 72})
+	require.NoError(t, err)
+	defer face.Close()
+
+	require.Equal(t, []string{"SOLD OUT"}, wrapText(face, "SOLD OUT", 1000))
+	require.Equal(t, []string{"SOLD", "OUT"}, wrapText(face, "SOLD OUT", 30))
+	require.Equal(t, []string{"a", "b c"}, wrapText(face, "a\nb  c", 1000))
+	require.Equal(t, []string{"unbreakable"}, wrapText(face, "unbreakable", 5))
+}
+
+func TestDrawText(t *testing.T) {
+	t.Parallel()
+	white := color.NRGBA{255, 255, 255, 255}
+	red := color.NRGBA{R: 255, A: 255}
+
+	tests := []struct {
+		position string
+		inside   image.Rectangle // where the text should be drawn
+	}{
+		{position: "north", inside: image.Rect(0, 0, 200, 50)},
+		{position: "south", inside: image.Rect(0, 150, 200, 200)},
+		{position: "west", inside: image.Rect(0, 50, 100, 150)},
+		{position: "southeast", inside: image.Rect(100, 150, 200, 200)},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.position, func(t *testing.T) {
+			t.Parallel()
+			img := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+			draw.Draw(img, img.Bounds(), image.NewUniform(white), image.Point{}, draw.Src)
+
+			err := drawText(img, Text{Content: "SOLD", Size: 20, Color: red, Position: tc.position})
+			require.NoError(t, err)
+
+			found := false
+			for y := 0; y < 200; y++ {
+				for x := 0; x < 200; x++ {
+					if img.NRGBAAt(x, y) != white {
+						require.Truef(t, image.Pt(x, y).In(tc.inside), "pixel %d,%d is outside of %v", x, y, tc.inside)
+						found = true
+					}
+				}
+			}
+			require.True(t, found, "text should be drawn")
+		})
+	}
+
+	// a font larger than the image is drawn at the height of the image
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	require.NoError(t, drawText(img, Text{Content: "A", Size: maxFontSize, Color: red, Position: "center"}))
+}
+
+func TestLoadFont(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "bold.ttf"), gobold.TTF, 0o600))
+	o := &Server{FontPath: dir}
+
+	f, err := o.loadFont("")
+	require.NoError(t, err)
+	require.Nil(t, f, "built in font should be used without font name")
+
+	f, err = o.loadFont("bold")
+	require.NoError(t, err)
+	require.NotNil(t, f)
+
+	cached, err := o.loadFont("bold")
+	require.NoError(t, err)
+	require.Same(t, f, cached)
+
+	_, err = o.loadFont("missing")
+	require.ErrorIs(t, err, ErrFontNotFound)
+	_, err = o.loadFont("../bold")
+	require.ErrorIs(t, err, ErrFontNotFound)
+
+	f, err = (&Server{}).loadFont("bold")
+	require.NoError(t, err)
+	require.Nil(t, f, "built in font should be used without font directory")
+}
@@ -0,0 +1,225 @@
+package internalhttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // thumbor signs URLs with HMAC-SHA1
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	thumborUnsafe        = "unsafe"
+	thumborFiltersPrefix = "filters:"
+	// length of the url safe base64 encoded HMAC-SHA1 signature
+	thumborSignatureLength = 28
+)
+
+var (
+	thumborCrop   = regexp.MustCompile(`^(\d+)x(\d+):(\d+)x(\d+)$`)
+	thumborSize   = regexp.MustCompile(`^(-?)(\d+|orig)?x(-?)(\d+|orig)?$`)
+	thumborFilter = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+
+	thumborHAlign = map[string]Gravity{
+		"left": GravityWest, "center": GravityCentre, "right": GravityEast,
+	}
+	thumborVAlign = map[string]Gravity{
+		"top": GravityNorth, "middle": GravityCentre, "bottom": GravitySouth,
+	}
+
+	ErrThumborSignature = errors.New("invalid thumbor URL signature")
+)
+
+// isThumborPath reports whether the path starts with the unsafe marker or something looking like a signature.
+func isThumborPath(path string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if first == thumborUnsafe {
+		return true
+	}
+	if len(first) != thumborSignatureLength {
+		return false
+	}
+	_, err := base64.URLEncoding.DecodeString(first)
+	return err == nil
+}
+
+// thumborRoute serves URLs written in the Thumbor dialect:
+// /{unsafe|signature}/[trim]/[AxB:CxD]/[fit-in]/[-]WxH/[halign]/[valign]/[smart]/[filters:...]/image.
+// Signed URLs are required once a key is configured, unsafe ones are accepted otherwise.
+func (o *Server) thumborRoute() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			o.Log.Error(fmt.Sprintf("unsupported method %s", r.Method))
+			o.failedRequest(w, r, "the method is not allowed")
+			return
+		}
+
+		path, err := o.verifyThumborPath(r.URL.EscapedPath())
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedRequest(w, r, err.Error())
+			return
+		}
+
+		image, opts, err := parseThumborPath(path)
+		if err != nil {
+			o.Log.Error(err.Error())
+			o.failedRequest(w, r, err.Error())
+			return
+		}
+
+		o.Log.Info(fmt.Sprintf("will resize thumbor URL %s as %s image at %s", path, opts.cacheKey(), image))
+
+		o.serveImage(w, r, o.ConvertedImageCache, image, opts)
+	}
+}
+
+// verifyThumborPath checks the signature or the unsafe marker and returns the path following it.
+func (o *Server) verifyThumborPath(escapedPath string) (string, error) {
+	signature, path, _ := strings.Cut(strings.TrimPrefix(escapedPath, "/"), "/")
+	if signature == thumborUnsafe {
+		if o.ThumborKey != "" {
+			return "", fmt.Errorf("%w: unsafe URLs are not allowed", ErrThumborSignature)
+		}
+		return path, nil
+	}
+	if o.ThumborKey == "" || !hmac.Equal([]byte(signature), []byte(thumborSignature(o.ThumborKey, path))) {
+		return "", fmt.Errorf("%w: (signature=%s)", ErrThumborSignature, signature)
+	}
+	return path, nil
+}
+
+// thumborSignature returns the signature thumbor expects for the path following it.
+func thumborSignature(key, path string) string {
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(path))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseThumborPath converts the thumbor options into resize options and returns them with the image URL.
+func parseThumborPath(path string) (string, Options, error) {
+	opts := Options{Operation: "fill", NoTrim: true}
+	parts := strings.Split(path, "/")
+	invalid := fmt.Errorf("invalid thumbor URL: (path=%s)", path)
+
+	// every option is optional but they have to come in order, the rest of the path is the image
+	i := 0
+	next := func(match func(string) bool) (string, bool) {
+		if i < len(parts) && match(parts[i]) {
+			i++
+			return parts[i-1], true
+		}
+		return "", false
+	}
+
+	if _, ok := next(func(s string) bool { return s == "trim" || strings.HasPrefix(s, "trim:") }); ok {
+		opts.NoTrim = false
+	}
+	if v, ok := next(thumborCrop.MatchString); ok {
+		m := thumborCrop.FindStringSubmatch(v)
+		left, _ := strconv.Atoi(m[1])
+		top, _ := strconv.Atoi(m[2])
+		right, _ := strconv.Atoi(m[3])
+		bottom, _ := strconv.Atoi(m[4])
+		if right <= left || bottom <= top {
+			return "", opts, invalid
+		}
+		opts.Extract = Region{
+			Left: float64(left), Top: float64(top), Width: float64(right - left), Height: float64(bottom - top),
+		}
+	}
+	// full-fit-in is approximated by fit-in, both keep the whole image within the size
+	if _, ok := next(func(s string) bool { return s == "fit-in" || s == "full-fit-in" || s == "adaptive-fit-in" }); ok {
+		opts.Operation = "fit"
+	}
+	flip := 0
+	if v, ok := next(thumborSize.MatchString); ok {
+		m := thumborSize.FindStringSubmatch(v)
+		// orig keeps the source dimension, which is what 0 does
+		opts.Width, _ = strconv.Atoi(m[2])
+		opts.Height, _ = strconv.Atoi(m[4])
+		// a horizontal flip is a mirror, a vertical one a mirror turned upside down
+		if m[1] == "-" {
+			opts.Mirror = !opts.Mirror
+		}
+		if m[3] == "-" {
+			opts.Mirror, flip = !opts.Mirror, 180
+		}
+	}
+	if v, ok := next(func(s string) bool { _, ok := thumborHAlign[s]; return ok }); ok {
+		opts.Gravity = thumborHAlign[v]
+	}
+	// engines have no corner gravities, the vertical alignment wins
+	if v, ok := next(func(s string) bool { _, ok := thumborVAlign[s]; return ok }); ok && v != "middle" {
+		opts.Gravity = thumborVAlign[v]
+	}
+	if _, ok := next(func(s string) bool { return s == "smart" }); ok {
+		opts.Gravity = GravitySmart
+	}
+	rotate := 0
+	if v, ok := next(func(s string) bool { return strings.HasPrefix(s, thumborFiltersPrefix) }); ok {
+		var err error
+		rotate, err = parseThumborFilters(strings.TrimPrefix(v, thumborFiltersPrefix), &opts)
+		if err != nil {
+			return "", opts, err
+		}
+	}
+
+	// the size is applied before the rotate filter turns the result
+	if rotate%180 != 0 {
+		opts.Width, opts.Height = opts.Height, opts.Width
+	}
+	opts.Rotate = (flip + rotate) % 360
+
+	image := strings.Join(parts[i:], "/")
+	if unescaped, err := url.PathUnescape(image); err == nil {
+		image = unescaped
+	}
+	if image == "" {
+		return "", opts, invalid
+	}
+	return image, opts, nil
+}
+
+// parseThumborFilters applies the supported filters to opts and returns the rotation requested by them.
+// Filters imgresizr has no counterpart for are ignored like thumbor ignores unknown filters.
+func parseThumborFilters(filters string, opts *Options) (int, error) {
+	rotate := 0
+	for _, m := range thumborFilter.FindAllStringSubmatch(filters, -1) {
+		name, arg := m[1], m[2]
+		var err error
+		switch name {
+		case "quality":
+			opts.Quality, err = strconv.Atoi(arg)
+			if err != nil || opts.Quality < 1 || opts.Quality > 100 {
+				return 0, fmt.Errorf("invalid thumbor filter: (filter=%s)", m[0])
+			}
+		case "format":
+			format, ok := formatsByName[strings.ToLower(arg)]
+			if !ok {
+				return 0, fmt.Errorf("unsupported output format: (format=%s)", arg)
+			}
+			opts.Format = format
+		case "grayscale":
+			opts.Grayscale = true
+		case "max_bytes":
+			opts.MaxBytes, err = strconv.Atoi(arg)
+			if err != nil || opts.MaxBytes < 1 {
+				return 0, fmt.Errorf("invalid thumbor filter: (filter=%s)", m[0])
+			}
+		case "rotate":
+			// thumbor rotates counterclockwise, imgresizr clockwise
+			rotate, err = strconv.Atoi(arg)
+			if err != nil || rotate%90 != 0 {
+				return 0, fmt.Errorf("invalid thumbor filter: (filter=%s)", m[0])
+			}
+			rotate = ((360-rotate)%360 + 360) % 360
+		}
+	}
+	return rotate, nil
+}
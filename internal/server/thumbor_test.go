@@ -0,0 +1,88 @@
+package internalhttp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThumborPath(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		path    string
+		image   string
+		want    Options
+		invalid bool
+	}{
+		{
+			path: "300x200/smart/filters:quality(80)/host/img.jpg", image: "host/img.jpg",
+			want: Options{
+				Operation: "fill", NoTrim: true, Width: 300, Height: 200, Gravity: GravitySmart, Quality: 80,
+			},
+		},
+		{
+			path: "trim/10x20:110x220/fit-in/-300x0/filters:format(webp):grayscale()/http%3A%2F%2Fhost%2Fimg.jpg",
+			want: Options{
+				Operation: "fit", Width: 300, Mirror: true, Format: WEBP, Grayscale: true,
+				Extract: Region{Left: 10, Top: 20, Width: 100, Height: 200},
+			},
+			image: "http://host/img.jpg",
+		},
+		{
+			path: "300x-200/left/bottom/filters:rotate(90):unknown(1)/host/img.jpg", image: "host/img.jpg",
+			want: Options{
+				Operation: "fill", NoTrim: true, Width: 200, Height: 300, Mirror: true, Rotate: 90,
+				Gravity: GravitySouth,
+			},
+		},
+		{
+			path: "origxorig/right/host/img.jpg", image: "host/img.jpg",
+			want: Options{Operation: "fill", NoTrim: true, Gravity: GravityEast},
+		},
+		{path: "300x200/", invalid: true},
+		{path: "20x20:10x10/host/img.jpg", invalid: true},
+		{path: "filters:quality(0)/host/img.jpg", invalid: true},
+		{path: "filters:format(tiff)/host/img.jpg", invalid: true},
+		{path: "filters:rotate(45)/host/img.jpg", invalid: true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+			image, opts, err := parseThumborPath(tc.path)
+			if tc.invalid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.image, image)
+			require.Equal(t, tc.want, opts)
+		})
+	}
+}
+
+func TestVerifyThumborPath(t *testing.T) {
+	t.Parallel()
+	path := "300x200/smart/host/img.jpg"
+	signature := thumborSignature("secret", path)
+	require.True(t, isThumborPath("/"+signature+"/"+path))
+	require.True(t, isThumborPath("/unsafe/"+path))
+	require.False(t, isThumborPath("/fill/300/200/host/img.jpg"))
+
+	unsigned := &Server{}
+	p, err := unsigned.verifyThumborPath("/unsafe/" + path)
+	require.NoError(t, err)
+	require.Equal(t, path, p)
+	_, err = unsigned.verifyThumborPath("/" + signature + "/" + path)
+	require.ErrorIs(t, err, ErrThumborSignature)
+
+	signed := &Server{ThumborKey: "secret"}
+	p, err = signed.verifyThumborPath("/" + signature + "/" + path)
+	require.NoError(t, err)
+	require.Equal(t, path, p)
+	_, err = signed.verifyThumborPath("/unsafe/" + path)
+	require.ErrorIs(t, err, ErrThumborSignature)
+	_, err = signed.verifyThumborPath("/" + signature + "/400x200/smart/host/img.jpg")
+	require.ErrorIs(t, err, ErrThumborSignature)
+}
@@ -0,0 +1,133 @@
+package internalhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Dmit1812/imgresizr/pkg/breaker"
+)
+
+const (
+	statusPath = "/status"
+
+	// delay before the first retry when none is configured.
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// upstreamStatus is the document served at the status endpoint.
+type upstreamStatus struct {
+	Upstreams []breaker.Status `json:"upstreams"`
+	Workers   *workersStatus   `json:"workers,omitempty"`
+}
+
+type workersStatus struct {
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+}
+
+// doUpstream sends the request to the source server retrying connection failures and 502, 503 and 504
+// responses with jittered exponential backoff. Requests to hosts whose circuit breaker is open fail fast.
+// Only answers below 500 count as successes of the host, timeouts count as failures and requests
+// the client gave up on count as neither.
+func (o *Server) doUpstream(ctx context.Context, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	breakers := o.upstreamBreakers()
+
+	for attempt := 0; ; attempt++ {
+		if breakers != nil {
+			if err := breakers.Allow(host); err != nil {
+				return nil, fmt.Errorf("%w: (host=%s)", err, host)
+			}
+		}
+
+		res, err := o.httpClient().Do(req.Clone(ctx))
+		retry := retryable(ctx, res, err)
+		if breakers != nil {
+			switch {
+			case errors.Is(ctx.Err(), context.Canceled):
+				// the client left, the request tells nothing about the origin
+				breakers.Cancel(host)
+			case err == nil && res.StatusCode < http.StatusInternalServerError:
+				breakers.Success(host)
+			default:
+				// server errors, broken connections and origins too slow to answer
+				breakers.Failure(host)
+			}
+		}
+		if !retry || attempt >= o.Retries {
+			return res, err
+		}
+		if res != nil {
+			// the connection is reused only once the body is consumed
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		o.Log.Warn(fmt.Sprintf("retrying download from %s, attempt %d of %d", host, attempt+1, o.Retries))
+		select {
+		case <-time.After(retryDelay(o.RetryBackoff, attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryable tells whether the request failed in a way a repeated GET may succeed, nothing is
+// retried once the context is done.
+func retryable(ctx context.Context, res *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	return res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusGatewayTimeout
+}
+
+// retryDelay doubles the delay with every attempt and picks a random one from its upper half.
+func retryDelay(backoff, attempt int) time.Duration {
+	delay := defaultRetryBackoff
+	if backoff > 0 {
+		delay = time.Duration(backoff) * time.Millisecond
+	}
+	delay <<= min(attempt, 16)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) //nolint:gosec // jitter needs no crypto
+}
+
+// upstreamBreakers returns the circuit breakers of the source hosts, nil if they are disabled.
+func (o *Server) upstreamBreakers() *breaker.Set {
+	o.breakersOnce.Do(func() {
+		if o.BreakerFailures > 0 {
+			o.breakers = breaker.New(o.BreakerFailures, time.Duration(o.BreakerCooldown)*time.Second)
+		}
+	})
+	return o.breakers
+}
+
+// statusRoute reports the state of the circuit breakers of the source hosts with recent failures
+// and the load of the worker pool.
+func (o *Server) statusRoute() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := upstreamStatus{Upstreams: []breaker.Status{}}
+		if breakers := o.upstreamBreakers(); breakers != nil {
+			status.Upstreams = breakers.Status()
+		}
+		if pool := o.workerPool(); pool != nil {
+			running, waiting := pool.Stats()
+			status.Workers = &workersStatus{Running: running, Waiting: waiting}
+		}
+
+		body, _ := json.Marshal(status)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
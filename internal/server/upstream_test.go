@@ -0,0 +1,139 @@
+package internalhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dmit1812/imgresizr/internal/logger"
+	"github.com/Dmit1812/imgresizr/pkg/breaker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadImageRetries(t *testing.T) {
+	t.Parallel()
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("image"))
+		}
+	}))
+	defer ts.Close()
+
+	o := &Server{HTTPReadTimeout: 5, Retries: 2, RetryBackoff: 1, Log: logger.New(logger.ERROR)}
+	buf, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL+"/flaky", nil)
+	require.NoError(t, err)
+	require.Equal(t, "image", string(buf))
+	require.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// missing images are not retried
+	_, _, err = o.LoadImageFromNetwork(context.Background(), ts.URL+"/missing", nil)
+	require.Error(t, err)
+	require.Equal(t, int32(4), atomic.LoadInt32(&hits))
+}
+
+func TestLoadImageCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	o := &Server{HTTPReadTimeout: 5, BreakerFailures: 2, BreakerCooldown: 60, Log: logger.New(logger.ERROR)}
+	for i := 0; i < 2; i++ {
+		_, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, breaker.ErrOpen)
+	}
+	_, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.ErrorIs(t, err, breaker.ErrOpen)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits), "requests should fail fast while the breaker is open")
+
+	w := httptest.NewRecorder()
+	o.NewServerMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, statusPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var status upstreamStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	u, _ := url.Parse(ts.URL)
+	require.Len(t, status.Upstreams, 1)
+	require.Equal(t, u.Host, status.Upstreams[0].Key)
+	require.Equal(t, "open", status.Upstreams[0].State)
+}
+
+func TestLoadImageCircuitBreakerTimeouts(t *testing.T) {
+	t.Parallel()
+	var recovered atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !recovered.Load() {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	defer ts.Close()
+
+	o := &Server{FetchTimeout: 1, BreakerFailures: 1, BreakerCooldown: 1, Log: logger.New(logger.ERROR)}
+	_, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, _, err = o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.ErrorIs(t, err, breaker.ErrOpen, "a hanging origin should open the breaker")
+
+	// a probe timing out opens the breaker again rather than leaving it waiting for the probe
+	time.Sleep(time.Second)
+	_, _, err = o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, _, err = o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.ErrorIs(t, err, breaker.ErrOpen)
+
+	recovered.Store(true)
+	require.Eventually(t, func() bool {
+		_, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+		return err == nil
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func TestLoadImageCircuitBreakerOutcomes(t *testing.T) {
+	t.Parallel()
+	var dials int32
+	// the dial hangs until the client gives up
+	hanging := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			<-ctx.Done()
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		},
+	}}
+	o := &Server{Client: hanging, Retries: 2, BreakerFailures: 1, BreakerCooldown: 60, Log: logger.New(logger.ERROR)}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, _, err := o.LoadImageFromNetwork(ctx, "http://origin.invalid/a.jpg", nil)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, breaker.ErrOpen, "a client leaving should not open the breaker")
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&dials), "a request the client left should not be retried")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	o = &Server{HTTPReadTimeout: 5, BreakerFailures: 1, BreakerCooldown: 60, Log: logger.New(logger.ERROR)}
+	_, _, err := o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.Error(t, err)
+	_, _, err = o.LoadImageFromNetwork(context.Background(), ts.URL, nil)
+	require.ErrorIs(t, err, breaker.ErrOpen, "a server error should count as a failure")
+}
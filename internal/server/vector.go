@@ -0,0 +1,42 @@
+package internalhttp
+
+import "math"
+
+const (
+	// natural density of the vector sources as libvips renders them by default.
+	vectorDPI = 72
+	// default limit of the pixels a vector source is rendered to.
+	defaultVectorMaxPixels = 50_000_000
+)
+
+func isVector(imageType ImageType) bool {
+	return imageType == SVG || imageType == PDF
+}
+
+// vectorScale returns the scale to render a vector image of the given natural size with,
+// so it covers the requested dimensions. An extreme aspect ratio would need a huge rendering
+// to cover them, the scale is kept so the rendering stays within the pixel limit.
+func vectorScale(width, height int, opts Options) float64 {
+	if width <= 0 || height <= 0 || (opts.Width <= 0 && opts.Height <= 0) {
+		return 1
+	}
+	limit := opts.VectorMaxPixels
+	if limit <= 0 {
+		limit = defaultVectorMaxPixels
+	}
+	scale := math.Max(float64(opts.Width)/float64(width), float64(opts.Height)/float64(height))
+	return math.Min(scale, math.Sqrt(float64(limit)/(float64(width)*float64(height))))
+}
+
+// vectorMaxPixels returns the limit of the pixels vector sources are rendered to: neither more
+// than a decoded source nor than an output may have.
+func (o *Server) vectorMaxPixels() int64 {
+	limit := int64(defaultVectorMaxPixels)
+	if o.MaxSourcePixels > 0 {
+		limit = min(limit, o.MaxSourcePixels)
+	}
+	if o.MaxArea > 0 {
+		limit = min(limit, o.MaxArea)
+	}
+	return limit
+}
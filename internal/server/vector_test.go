@@ -0,0 +1,60 @@
+package internalhttp
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVectorScale(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, 1.0, vectorScale(100, 50, Options{}))
+	require.Equal(t, 1.0, vectorScale(0, 0, Options{Width: 10}))
+	require.Equal(t, 4.0, vectorScale(100, 50, Options{Width: 400}))
+	require.Equal(t, 4.0, vectorScale(100, 50, Options{Width: 200, Height: 200}))
+	require.Equal(t, 0.5, vectorScale(100, 50, Options{Width: 50, Height: 10}))
+
+	// covering 2000x2000 with a 1x10000 image would render 2000x20000000 pixels
+	scale := vectorScale(1, 10000, Options{Width: 2000, Height: 2000})
+	require.InDelta(t, math.Sqrt(defaultVectorMaxPixels/10000.0), scale, 1e-9)
+	scale = vectorScale(1, 10000, Options{Width: 2000, Height: 2000, VectorMaxPixels: 1_000_000})
+	require.InDelta(t, 10.0, scale, 1e-9)
+	require.LessOrEqual(t, scale*scale*10000, 1_000_000.0)
+
+	require.Equal(t, int64(defaultVectorMaxPixels), (&Server{}).vectorMaxPixels())
+	require.Equal(t, int64(1000), (&Server{MaxSourcePixels: 5000, MaxArea: 1000}).vectorMaxPixels())
+}
+
+func TestCheckImageVectors(t *testing.T) {
+	t.Parallel()
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`)
+	pdf := []byte("%PDF-1.4\n%%EOF\n")
+
+	o := &Server{}
+	require.ErrorIs(t, o.checkImage(svg, "a.svg"), ErrNotImage)
+	require.ErrorIs(t, o.checkImage(pdf, "a.pdf"), ErrNotImage)
+
+	// once enabled they are left to the engine to decode
+	o = &Server{AllowSVG: true, AllowPDF: true}
+	require.NotErrorIs(t, o.checkImage(svg, "a.svg"), ErrNotImage)
+	require.NotErrorIs(t, o.checkImage(pdf, "a.pdf"), ErrNotImage)
+}
+
+func TestServeImageRejectsVectors(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`))
+	}))
+	defer ts.Close()
+
+	o := newTestServer(t)
+	o.NoErrorImage = true
+	w := httptest.NewRecorder()
+	o.serveImage(w, httptest.NewRequest(http.MethodGet, "/fill/10/10/"+ts.URL, nil),
+		o.ConvertedImageCache, ts.URL, Options{Operation: "fill", Width: 10, Height: 10})
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.Equal(t, "not_an_image", w.Header().Get(HeaderErrorCode))
+}
@@ -0,0 +1,97 @@
+//go:build cgo && !purego
+
+package internalhttp
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+static int imgresizr_svgload(void *buf, size_t len, VipsImage **out, double scale) {
+	return vips_svgload_buffer(buf, len, out, "scale", scale, "access", VIPS_ACCESS_RANDOM, NULL);
+}
+
+static int imgresizr_pdfload(void *buf, size_t len, VipsImage **out, int page, double dpi) {
+	return vips_pdfload_buffer(buf, len, out, "page", page, "dpi", dpi, "access", VIPS_ACCESS_RANDOM, NULL);
+}
+
+static int imgresizr_pngsave(VipsImage *in, void **buf, size_t *len) {
+	return vips_pngsave_buffer(in, buf, len, "compression", 1, NULL);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// rasterizeVector renders an SVG image or a page of a PDF document to PNG at the density
+// needed for the requested dimensions, so the vectors stay crisp at any output size.
+func rasterizeVector(buf []byte, imageType ImageType, opts Options) ([]byte, error) {
+	page := opts.Page
+	if page == 0 {
+		page = 1
+	}
+	if page > 1 && imageType != PDF {
+		return nil, fmt.Errorf("%w: (page=%d) (pages=1)", ErrOutOfRange, page)
+	}
+
+	width, height, err := loadVector(buf, imageType, page, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	_, _, err = loadVector(buf, imageType, page, vectorScale(width, height, opts), &out)
+	return out, err
+}
+
+// loadVector loads the vector image at the given scale and returns its size.
+// If out is provided the image is also rendered into it as PNG.
+func loadVector(buf []byte, imageType ImageType, page int, scale float64, out *[]byte) (int, int, error) {
+	if len(buf) == 0 {
+		return 0, 0, errors.New("empty vector image")
+	}
+
+	// libvips keeps referring to the buffer for as long as the image lives
+	cbuf := C.CBytes(buf)
+	defer C.free(cbuf)
+
+	var image *C.VipsImage
+	var code C.int
+	if imageType == SVG {
+		code = C.imgresizr_svgload(cbuf, C.size_t(len(buf)), &image, C.double(scale))
+	} else {
+		code = C.imgresizr_pdfload(cbuf, C.size_t(len(buf)), &image, C.int(page-1), C.double(scale*vectorDPI))
+	}
+	if code != 0 {
+		return 0, 0, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(image))
+
+	width := int(C.vips_image_get_width(image))
+	height := int(C.vips_image_get_height(image))
+	if out == nil {
+		return width, height, nil
+	}
+
+	var ptr unsafe.Pointer
+	var length C.size_t
+	if C.imgresizr_pngsave(image, &ptr, &length) != 0 {
+		return 0, 0, vipsError()
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	*out = C.GoBytes(ptr, C.int(length))
+	return width, height, nil
+}
+
+// vipsError takes the message out of the error buffer of libvips. The buffer is shared by
+// the whole process, the message of a failure happening at the same time may end up in it too.
+func vipsError() error {
+	msg := C.GoString(C.vips_error_buffer())
+	C.vips_error_clear()
+	return errors.New(msg)
+}
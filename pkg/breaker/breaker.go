@@ -0,0 +1,119 @@
+package breaker
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int
+
+const (
+	Closed   State = iota // requests pass
+	Open                  // requests fail fast until the cooldown is over
+	HalfOpen              // a single probe request passes to decide whether to close again
+)
+
+func (s State) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// Set holds a circuit breaker per key. A breaker opens after threshold consecutive failures,
+// fails fast for the cooldown and then lets one probe through, its success closes the breaker again.
+type Set struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	breakers  map[string]*breaker
+}
+
+type breaker struct {
+	state    State
+	failures int
+	openedAt time.Time
+}
+
+// Status is the state of the breaker of a key.
+type Status struct {
+	Key      string    `json:"key"`
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"openedAt,omitempty"`
+}
+
+func New(threshold int, cooldown time.Duration) *Set {
+	return &Set{threshold: max(threshold, 1), cooldown: cooldown, now: time.Now, breakers: map[string]*breaker{}}
+}
+
+// Allow returns ErrOpen if requests for the key should fail fast.
+func (s *Set) Allow(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		return nil
+	}
+	switch b.state {
+	case Closed:
+		return nil
+	case Open:
+		if s.now().Sub(b.openedAt) < s.cooldown {
+			return ErrOpen
+		}
+		b.state = HalfOpen
+		return nil
+	case HalfOpen:
+		// the probe is still running
+		return ErrOpen
+	}
+	return nil
+}
+
+// Success records a successful request, it closes the breaker.
+func (s *Set) Success(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// keys without failures are not tracked
+	delete(s.breakers, key)
+}
+
+// Failure records a failed request, it opens the breaker once the threshold is reached or the probe failed.
+func (s *Set) Failure(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &breaker{}
+		s.breakers[key] = b
+	}
+	b.failures++
+	if b.state == HalfOpen || b.failures >= s.threshold {
+		b.state, b.openedAt = Open, s.now()
+	}
+}
+
+// Cancel records a request that ended without an outcome, e.g. as its client left. A breaker
+// waiting for it as its probe lets the next request probe instead.
+func (s *Set) Cancel(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.breakers[key]; ok && b.state == HalfOpen {
+		b.state = Open
+	}
+}
+
+// Status returns the state of the breakers of the keys with recent failures ordered by key.
+func (s *Set) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make([]Status, 0, len(s.breakers))
+	for key, b := range s.breakers {
+		status = append(status, Status{Key: key, State: b.state.String(), Failures: b.failures, OpenedAt: b.openedAt})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Key < status[j].Key })
+	return status
+}
@@ -0,0 +1,54 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSet(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New(3, time.Minute)
+	s.now = func() time.Time { return now }
+
+	// failures under the threshold keep the breaker closed
+	s.Failure("a")
+	s.Failure("a")
+	require.NoError(t, s.Allow("a"))
+	require.Equal(t, []Status{{Key: "a", State: "closed", Failures: 2}}, s.Status())
+
+	// a success resets the count
+	s.Success("a")
+	require.Empty(t, s.Status())
+
+	for i := 0; i < 3; i++ {
+		s.Failure("a")
+	}
+	require.ErrorIs(t, s.Allow("a"), ErrOpen)
+	require.NoError(t, s.Allow("b"), "other keys are not affected")
+	require.Equal(t, []Status{{Key: "a", State: "open", Failures: 3, OpenedAt: now}}, s.Status())
+
+	// after the cooldown a single probe passes
+	now = now.Add(time.Minute)
+	require.NoError(t, s.Allow("a"))
+	require.ErrorIs(t, s.Allow("a"), ErrOpen)
+
+	// a failed probe opens the breaker again
+	s.Failure("a")
+	require.ErrorIs(t, s.Allow("a"), ErrOpen)
+
+	// a canceled probe lets the next request probe
+	now = now.Add(time.Minute)
+	require.NoError(t, s.Allow("a"))
+	s.Cancel("a")
+	require.NoError(t, s.Allow("a"))
+	require.ErrorIs(t, s.Allow("a"), ErrOpen)
+	s.Failure("a")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, s.Allow("a"))
+	s.Success("a")
+	require.NoError(t, s.Allow("a"))
+	require.NoError(t, s.Allow("a"))
+}
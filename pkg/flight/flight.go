@@ -0,0 +1,101 @@
+package flight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrPanic is returned to the callers of a call that panicked.
+var ErrPanic = errors.New("call panicked")
+
+// Group makes sure only one call per key runs at a time, callers asking for a key that is already
+// in flight wait for the result of that call instead of starting their own.
+// The zero value is ready to use.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	val     T
+	err     error
+}
+
+// Do runs fn for the key unless a call for it is in flight already and waits for the result
+// or until ctx is done. The context fn gets is not canceled with the context of the caller
+// that started the call, it is canceled once no caller waits for the result anymore.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go g.run(callCtx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.leave(key, c)
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Waiters returns the number of callers waiting for the call in flight for the key.
+func (g *Group[T]) Waiters(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.waiters
+	}
+	return 0
+}
+
+func (g *Group[T]) run(ctx context.Context, key string, c *call[T], fn func(ctx context.Context) (T, error)) {
+	defer func() {
+		// the call runs on its own goroutine, a panic there would take the whole process down
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("%w: %v", ErrPanic, r)
+		}
+		c.cancel()
+		g.forget(key, c)
+		close(c.done)
+	}()
+	c.val, c.err = fn(ctx)
+}
+
+// leave drops a waiter, the last one to leave cancels the call so nobody works for nothing.
+func (g *Group[T]) leave(key string, c *call[T]) {
+	g.mu.Lock()
+	c.waiters--
+	last := c.waiters == 0
+	if last && g.calls[key] == c {
+		// the next caller starts afresh instead of joining the canceled call
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	if last {
+		c.cancel()
+	}
+}
+
+func (g *Group[T]) forget(key string, c *call[T]) {
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+}
@@ -0,0 +1,121 @@
+package flight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup(t *testing.T) {
+	t.Run("concurrent callers share one call", func(t *testing.T) {
+		var g Group[int]
+		var calls int32
+		release := make(chan struct{})
+
+		var wg sync.WaitGroup
+		results := make([]int, 10)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], _ = g.Do(context.Background(), "key", func(ctx context.Context) (int, error) {
+					atomic.AddInt32(&calls, 1)
+					<-release
+					return 42, nil
+				})
+			}(i)
+		}
+		require.Eventually(t, func() bool { return g.Waiters("key") == 10 }, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		for _, v := range results {
+			require.Equal(t, 42, v)
+		}
+		require.Zero(t, g.Waiters("key"))
+	})
+
+	t.Run("call continues while somebody waits", func(t *testing.T) {
+		var g Group[int]
+		release := make(chan struct{})
+		started := make(chan struct{})
+		fn := func(ctx context.Context) (int, error) {
+			close(started)
+			select {
+			case <-release:
+				return 1, nil
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() {
+			_, err := g.Do(ctx, "key", fn)
+			errs <- err
+		}()
+		<-started
+
+		result := make(chan int, 1)
+		go func() {
+			v, _ := g.Do(context.Background(), "key", fn)
+			result <- v
+		}()
+		require.Eventually(t, func() bool { return g.Waiters("key") == 2 }, time.Second, time.Millisecond)
+
+		// the caller that started the call leaves, the other one still gets the result
+		cancel()
+		require.ErrorIs(t, <-errs, context.Canceled)
+		close(release)
+		require.Equal(t, 1, <-result)
+	})
+
+	t.Run("call is canceled when every caller left", func(t *testing.T) {
+		var g Group[int]
+		canceled := make(chan error, 1)
+		started := make(chan struct{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() {
+			_, err := g.Do(ctx, "key", func(ctx context.Context) (int, error) {
+				close(started)
+				<-ctx.Done()
+				canceled <- ctx.Err()
+				return 0, ctx.Err()
+			})
+			errs <- err
+		}()
+		<-started
+		cancel()
+
+		require.ErrorIs(t, <-errs, context.Canceled)
+		require.ErrorIs(t, <-canceled, context.Canceled)
+
+		// a new caller starts a new call
+		v, err := g.Do(context.Background(), "key", func(ctx context.Context) (int, error) { return 2, nil })
+		require.NoError(t, err)
+		require.Equal(t, 2, v)
+	})
+
+	t.Run("errors are shared", func(t *testing.T) {
+		var g Group[int]
+		errFailed := errors.New("failed")
+		_, err := g.Do(context.Background(), "key", func(ctx context.Context) (int, error) { return 0, errFailed })
+		require.ErrorIs(t, err, errFailed)
+	})
+
+	t.Run("panics become errors", func(t *testing.T) {
+		var g Group[int]
+		_, err := g.Do(context.Background(), "key", func(ctx context.Context) (int, error) { panic("boom") })
+		require.ErrorIs(t, err, ErrPanic)
+		require.Zero(t, g.Waiters("key"))
+	})
+}
@@ -0,0 +1,121 @@
+package workpool
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("work queue is full")
+
+// Pool limits the number of jobs running at once. Jobs over the limit wait in a bounded queue,
+// the one with the lowest priority value goes first and jobs of equal priority go in arrival order.
+type Pool struct {
+	mu       sync.Mutex
+	workers  int
+	queueLen int
+	running  int
+	seq      uint64
+	queue    waitQueue
+}
+
+// New creates a pool running up to workers jobs at once with up to queueLen jobs waiting.
+func New(workers, queueLen int) *Pool {
+	return &Pool{workers: max(workers, 1), queueLen: max(queueLen, 0)}
+}
+
+// Acquire waits for a free worker until ctx is done and returns the function releasing it.
+// It fails right away with ErrQueueFull if the queue has no room.
+func (p *Pool) Acquire(ctx context.Context, priority int64) (func(), error) {
+	p.mu.Lock()
+	if p.running < p.workers && p.queue.Len() == 0 {
+		p.running++
+		p.mu.Unlock()
+		return p.release, nil
+	}
+	if p.queue.Len() >= p.queueLen {
+		p.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{}), priority: priority, seq: p.seq}
+	p.seq++
+	heap.Push(&p.queue, w)
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return p.release, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		granted := w.index < 0
+		if !granted {
+			heap.Remove(&p.queue, w.index)
+		}
+		p.mu.Unlock()
+		if granted {
+			// the worker was handed over meanwhile, pass it on
+			p.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns the number of jobs running and waiting.
+func (p *Pool) Stats() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running, p.queue.Len()
+}
+
+// release hands the worker over to the first waiting job or frees it.
+func (p *Pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queue.Len() == 0 {
+		p.running--
+		return
+	}
+	w := heap.Pop(&p.queue).(*waiter)
+	close(w.ready)
+}
+
+type waiter struct {
+	ready    chan struct{}
+	priority int64
+	seq      uint64
+	index    int // position in the queue, -1 once the worker is handed over
+}
+
+// waitQueue is a heap of the waiting jobs ordered by priority and arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
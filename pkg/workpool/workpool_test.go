@@ -0,0 +1,84 @@
+package workpool
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	t.Run("limits running jobs and the queue", func(t *testing.T) {
+		p := New(2, 1)
+		r1, err := p.Acquire(context.Background(), 0)
+		require.NoError(t, err)
+		r2, err := p.Acquire(context.Background(), 0)
+		require.NoError(t, err)
+
+		acquired := make(chan func(), 1)
+		go func() {
+			r, err := p.Acquire(context.Background(), 0)
+			require.NoError(t, err)
+			acquired <- r
+		}()
+		require.Eventually(t, func() bool { _, waiting := p.Stats(); return waiting == 1 }, time.Second, time.Millisecond)
+
+		_, err = p.Acquire(context.Background(), 0)
+		require.ErrorIs(t, err, ErrQueueFull)
+
+		r1()
+		r3 := <-acquired
+		r2()
+		r3()
+		running, waiting := p.Stats()
+		require.Zero(t, running)
+		require.Zero(t, waiting)
+	})
+
+	t.Run("waiting stops with the context", func(t *testing.T) {
+		p := New(1, 1)
+		r, err := p.Acquire(context.Background(), 0)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = p.Acquire(ctx, 0)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		r()
+		running, waiting := p.Stats()
+		require.Zero(t, running)
+		require.Zero(t, waiting)
+	})
+
+	t.Run("lower priority values go first", func(t *testing.T) {
+		p := New(1, 10)
+		r, err := p.Acquire(context.Background(), 0)
+		require.NoError(t, err)
+
+		var mu sync.Mutex
+		var order []int64
+		var wg sync.WaitGroup
+		for i, priority := range []int64{300, 100, 200, 100} {
+			wg.Add(1)
+			go func(priority int64) {
+				defer wg.Done()
+				release, err := p.Acquire(context.Background(), priority)
+				require.NoError(t, err)
+				mu.Lock()
+				order = append(order, priority)
+				mu.Unlock()
+				release()
+			}(priority)
+			want := i + 1
+			require.Eventually(t, func() bool { _, waiting := p.Stats(); return waiting == want },
+				time.Second, time.Millisecond)
+		}
+
+		r()
+		wg.Wait()
+		require.Equal(t, []int64{100, 100, 200, 300}, order)
+	})
+}
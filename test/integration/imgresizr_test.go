@@ -18,7 +18,6 @@ import (
 	"github.com/Dmit1812/imgresizr/internal/lrufilecache"
 	internalhttp "github.com/Dmit1812/imgresizr/internal/server"
 	"github.com/Dmit1812/imgresizr/internal/utilities"
-	"github.com/h2non/bimg"
 	"github.com/stretchr/testify/require"
 )
 
@@ -203,8 +202,7 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 		intime := elapsed1 > time.Second
 		require.Truef(t, intime, "download time should be over 1 second for item without cache, but it was %s", elapsed1)
 
-		image1 := bimg.NewImage(image1Bytes)
-		_, err = image1.Size()
+		_, err = internalhttp.GetImageSize(image1Bytes)
 		require.NoError(t, err, "downloaded image without cache should be a valid image with size, but it was not")
 
 		start = time.Now()
@@ -220,8 +218,7 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 			"image download time from cache should be at least two times faster then without cache, but it was %s vs %s",
 			elapsed2.String(), elapsed1.String())
 
-		image2 := bimg.NewImage(image2Bytes)
-		_, err = image2.Size()
+		_, err = internalhttp.GetImageSize(image2Bytes)
 		require.NoError(t, err, "the downloaded item should be a valid image with size, but it was not")
 
 		require.True(t, compareBytes(image1Bytes, image2Bytes),
@@ -255,7 +252,7 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 	// check that our image server presents client headers to the image holder in request
 	// nginx configured so it responds with 50x50 image on a specific url /check-header
 	// it returns 403 if no header X-Test-Header: "ATestHeaderFromClient" present in request
-	// imgresizr presents this as 400 error and an image
+	// imgresizr presents this as 502 error and an image
 	// it return 200 and 50x50 image if such header present in request
 	// so if imgresizer passes this header we are good
 	tg.Add(1)
@@ -267,9 +264,9 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 		// skip wait time for deletion - erase ourselves
 		forceCleanCache()
 
-		// confirm test is configured correctly (expect 400)
+		// confirm test is configured correctly (expect 502)
 		_, status, _, err := curl("http://localhost:9000/fill/51/51/http://localhost:8080/check-header", nil)
-		require.Equalf(t, 400, status, "should get 400 after request without X-Test-Header")
+		require.Equalf(t, 502, status, "should get 502 after request without X-Test-Header")
 		require.Error(t, err)
 
 		// request with header set
@@ -280,8 +277,7 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 		require.Equalf(t, 200, status, "source server should return 200 status code, but we got %d", status)
 
 		// check for image validity should be 52x52
-		image := bimg.NewImage(imageBytes)
-		size, err := image.Size()
+		size, err := internalhttp.GetImageSize(imageBytes)
 		require.NoError(t, err, "the downloaded item should be a valid image with size, but it was not")
 		imagecorrect := (size.Width == 52 && size.Height == 52)
 		require.Truef(t, imagecorrect, "image should be 52x52, but it was %dx%d", size.Width, size.Height)
@@ -295,7 +291,8 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 	t.Run("remote server doesn't exist", func(t *testing.T) {
 		defer tg.Done()
 		_, status, headers, _ := curl("http://localhost:9000/fill/50/50/http://zupa:8080/gopher_50x50.jpg", nil)
-		require.Equalf(t, 400, status, "should get 400 after request to non-existing server, but got %d", status)
+		require.Equalf(t, 502, status, "should get 502 after request to non-existing server, but got %d", status)
+		require.Equal(t, "upstream_error", headers.Get("Error-Code"))
 		require.Containsf(t, headers.Get("Error"),
 			"dial tcp: lookup zupa", "should get correct 'Error' header after request")
 	})
@@ -306,7 +303,8 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 	t.Run("image on remote server doesn't exist", func(t *testing.T) {
 		defer tg.Done()
 		_, status, headers, _ := curl("http://localhost:9000/fill/50/50/http://localhost:8080/lola", nil)
-		require.Equalf(t, 400, status, "should get 400 after request to non-existing server, but got %d", status)
+		require.Equalf(t, 404, status, "should get 404 after request for non-existing image, but got %d", status)
+		require.Equal(t, "source_not_found", headers.Get("Error-Code"))
 		require.Containsf(t, headers.Get("Error"),
 			"error downloading image: (status=404)", "should get correct 'Error' header after request")
 	})
@@ -317,7 +315,8 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 	t.Run("image on remote server is not an image", func(t *testing.T) {
 		defer tg.Done()
 		_, status, headers, _ := curl("http://localhost:9000/fill/50/50/http://localhost:8080/imgresizr", nil)
-		require.Equalf(t, 400, status, "should get 400 after request to non-existing server, but got %d", status)
+		require.Equalf(t, 502, status, "should get 502 after request for a non-image, but got %d", status)
+		require.Equal(t, "not_an_image", headers.Get("Error-Code"))
 		require.Containsf(t, headers.Get("Error"),
 			"invalid image at URL", "should get correct 'Error' header after request")
 	})
@@ -328,7 +327,8 @@ func TestImgresizrIntegration(t *testing.T) { //nolint:funlen
 	t.Run("remote image server returned 500", func(t *testing.T) {
 		defer tg.Done()
 		_, status, headers, _ := curl("http://localhost:9000/fill/100/200/http://localhost:8080/error", nil)
-		require.Equalf(t, 400, status, "should get 400 after request to non-existing server, but got %d", status)
+		require.Equalf(t, 502, status, "should get 502 after upstream error, but got %d", status)
+		require.Equal(t, "upstream_status", headers.Get("Error-Code"))
 		require.Containsf(t, headers.Get("Error"),
 			"error downloading image: (status=500)", "should get correct 'Error' header after request to non-existing server")
 	})